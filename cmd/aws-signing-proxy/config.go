@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/config"
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// readConfig reads the environment on top of the config file, if any. The environment is only read, so the secrets
+// of the file do not end up in it. Problems of the file are reported at once as *config.ValidationError, its valid
+// settings are read nevertheless, so they do not show up as missing as well.
+func readConfig(path string) (EnvConfig, error) {
+	var e EnvConfig
+	if err := envconfig.Process("ASP", &e); err != nil {
+		return e, err
+	}
+	if path == "" {
+		return e, nil
+	}
+
+	schema, err := config.NewSchema("ASP", &EnvConfig{})
+	if err != nil {
+		return e, err
+	}
+	var file configFile
+	err = config.Load(path, &file)
+	if applyErr := schema.Apply(&file, &e); applyErr != nil {
+		return e, applyErr
+	}
+	file.applyFileOnly(&e)
+	return e, err
+}
+
+// validateConfig reports every invalid setting at once, no matter whether it comes from the environment or the config file
+func validateConfig(e EnvConfig) error {
+	problems := &config.ValidationError{}
+
+	if target, err := url.Parse(e.TargetUrl); err != nil || target.Scheme == "" || target.Host == "" {
+		problems.Addf("ASP_TARGET_URL: %q is not an absolute URL", e.TargetUrl)
+	}
+	for i, failoverTarget := range failoverTargets(e) {
+		if target, err := url.Parse(failoverTarget.Url); err != nil || target.Scheme == "" || target.Host == "" {
+			if e.FailoverTargetUrl != "" {
+				problems.Addf("ASP_FAILOVER_TARGET_URL: %q is not an absolute URL", failoverTarget.Url)
+			} else {
+				problems.Addf("failover.targets[%d].url: %q is not an absolute URL", i, failoverTarget.Url)
+			}
+		}
+	}
+	// the server name is verified for every target, which only fits the certificate of one of them
+	if e.TlsServerName != "" && len(failoverTargets(e)) > 0 {
+		problems.Addf("ASP_TLS_SERVER_NAME: cannot be combined with failover targets")
+	}
+
+	for _, setting := range missingSettings(e) {
+		problems.Addf("%s: required for the %s credentials provider", setting, e.CredentialsProvider)
+	}
+
+	if _, err := zapcore.ParseLevel(e.LogLevel); err != nil {
+		problems.Addf("ASP_LOG_LEVEL: %q is not one of debug, info, warn or error", e.LogLevel)
+	}
+	if e.LogEncoding != "json" && e.LogEncoding != "console" {
+		problems.Addf("ASP_LOG_ENCODING: %q is neither json nor console", e.LogEncoding)
+	}
+
+	ratios := []struct {
+		envVar string
+		value  float64
+	}{
+		{"ASP_CIRCUIT_BREAKER_FAILURE_RATIO", e.CircuitBreakerFailureRatio},
+		{"ASP_UPSTREAM_CIRCUIT_BREAKER_FAILURE_RATIO", e.UpstreamCircuitBreakerFailureRatio},
+		{"ASP_RETRY_BUDGET_RATIO", e.RetryBudgetRatio},
+		{"ASP_ACCESS_LOG_SAMPLE_RATE", e.AccessLogSampleRate},
+	}
+	for _, ratio := range ratios {
+		if ratio.value < 0 || ratio.value > 1 {
+			problems.Addf("%s: %v is not between 0 and 1", ratio.envVar, ratio.value)
+		}
+	}
+	providerBreakers := []struct {
+		name      string
+		overrides CircuitBreakerOverrides
+	}{
+		{"vault.circuit_breaker", e.VaultCircuitBreaker},
+		{"open_id.circuit_breaker", e.OpenIdCircuitBreaker},
+	}
+	for _, breaker := range providerBreakers {
+		if ratio := breaker.overrides.FailureRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+			problems.Addf("%s.failure_ratio: %v is not between 0 and 1", breaker.name, *ratio)
+		}
+	}
+
+	if e.RetryMinBackoff > e.RetryMaxBackoff {
+		problems.Addf("ASP_RETRY_MIN_BACKOFF: %s is greater than ASP_RETRY_MAX_BACKOFF %s", e.RetryMinBackoff, e.RetryMaxBackoff)
+	}
+	if _, err := parseNetworks(e.SignatureDebugTrustedNetworks); err != nil {
+		problems.Addf("ASP_SIGNATURE_DEBUG_TRUSTED_NETWORKS: %v", err)
+	}
+	if _, err := parseNetworks(e.AccessLogTrustedProxies); err != nil {
+		problems.Addf("ASP_ACCESS_LOG_TRUSTED_PROXIES: %v", err)
+	}
+
+	durations := []struct {
+		envVar string
+		value  time.Duration
+	}{
+		{"ASP_SERVER_READ_HEADER_TIMEOUT", e.ServerReadHeaderTimeout},
+		{"ASP_SERVER_READ_TIMEOUT", e.ServerReadTimeout},
+		{"ASP_SERVER_WRITE_TIMEOUT", e.ServerWriteTimeout},
+		{"ASP_SERVER_IDLE_TIMEOUT", e.ServerIdleTimeout},
+		{"ASP_RESPONSE_HEADER_TIMEOUT", e.ResponseHeaderTimeout},
+		{"ASP_EXPECT_CONTINUE_TIMEOUT", e.ExpectContinueTimeout},
+		{"ASP_TLS_HANDSHAKE_TIMEOUT", e.TlsHandshakeTimeout},
+		{"ASP_SHUTDOWN_DELAY", e.ShutdownDelay},
+		{"ASP_SHUTDOWN_TIMEOUT", e.ShutdownTimeout},
+	}
+	for _, duration := range durations {
+		if duration.value < 0 {
+			problems.Addf("%s: %s is negative", duration.envVar, duration.value)
+		}
+	}
+	if _, err := newTransportConfig(e); err != nil {
+		problems.Add(err)
+	}
+	if _, err := newStsConfig(e, nil); err != nil {
+		problems.Add(err)
+	}
+	if e.ServerMaxHeaderBytes <= 0 {
+		problems.Addf("ASP_SERVER_MAX_HEADER_BYTES: %d is not positive", e.ServerMaxHeaderBytes)
+	}
+	if e.MaxRequestBodyBytes < 0 {
+		problems.Addf("ASP_MAX_REQUEST_BODY_BYTES: %d is negative", e.MaxRequestBodyBytes)
+	}
+
+	return problems.ErrorOrNil()
+}
+
+// requiredSetting is a setting the credentials provider cannot do without
+type requiredSetting struct {
+	name  string
+	value string
+}
+
+// missingSettings lists the settings required by the credentials provider which are empty. The parsed configuration
+// is checked, so the settings may come from the config file as well.
+func missingSettings(e EnvConfig) []string {
+	var required []requiredSetting
+	switch e.CredentialsProvider {
+	case "oidc":
+		required = []requiredSetting{
+			{"ASP_OPEN_ID_AUTH_SERVER_URL", e.OpenIdAuthServerUrl},
+			{"ASP_OPEN_ID_CLIENT_ID", e.OpenIdClientId},
+			{"ASP_OPEN_ID_CLIENT_SECRET", e.OpenIdClientSecret},
+			{"ASP_ROLE_ARN", e.RoleArn},
+		}
+	case "vault":
+		required = []requiredSetting{
+			{"ASP_VAULT_URL", e.VaultUrl},
+			{"ASP_VAULT_CREDENTIALS_PATH", e.VaultCredentialsPath},
+			{"ASP_VAULT_AUTH_TOKEN", e.VaultAuthToken},
+		}
+	case "irsa":
+		required = []requiredSetting{
+			{"ASP_ROLE_ARN", e.RoleArn},
+			// read from the environment by the irsa package, like the AWS SDK does
+			{"AWS_WEB_IDENTITY_TOKEN_FILE", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")},
+		}
+	}
+
+	var missing []string
+	for _, setting := range required {
+		if strings.TrimSpace(setting.value) == "" {
+			missing = append(missing, setting.name)
+		}
+	}
+	return missing
+}
+
+// validate checks a config file together with the environment without starting the proxy
+func validate(args []string, out io.Writer) int {
+	path := os.Getenv("ASP_CONFIG_FILE")
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		_, _ = fmt.Fprintln(out, "usage: aws-signing-proxy validate <config file>")
+		return 2
+	}
+
+	problems := &config.ValidationError{}
+	e, err := readConfig(path)
+	problems.Add(err)
+	// the settings are checked as well unless the environment or the file could not be read at all
+	var fileProblems *config.ValidationError
+	if err == nil || errors.As(err, &fileProblems) {
+		problems.Add(validateConfig(e))
+	}
+
+	if err := problems.ErrorOrNil(); err != nil {
+		_, _ = fmt.Fprintf(out, "%s is invalid: %v\n", path, err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "%s is valid\n", path)
+	return 0
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"time"
+)
+
+// configFile is version 1 of the config file. Settings tagged with env stand for that environment variable, which
+// overrides them. The others can only be set in the file: several failover targets and circuit breakers per credentials provider.
+type configFile struct {
+	Version             int            `yaml:"version"`
+	TargetUrl           *string        `yaml:"target_url" env:"ASP_TARGET_URL"`
+	Service             *string        `yaml:"service" env:"ASP_SERVICE"`
+	Port                *int           `yaml:"port" env:"ASP_PORT"`
+	MgmtPort            *int           `yaml:"mgmt_port" env:"ASP_MGMT_PORT"`
+	AdminToken          *string        `yaml:"admin_token" env:"ASP_ADMIN_TOKEN"`
+	FlushInterval       *time.Duration `yaml:"flush_interval" env:"ASP_FLUSH_INTERVAL"`
+	IdleConnTimeout     *time.Duration `yaml:"idle_conn_timeout" env:"ASP_IDLE_CONN_TIMEOUT"`
+	DialTimeout         *time.Duration `yaml:"dial_timeout" env:"ASP_DIAL_TIMEOUT"`
+	MaxRequestBodyBytes *int64         `yaml:"max_request_body_bytes" env:"ASP_MAX_REQUEST_BODY_BYTES"`
+	ConfigWatchInterval *time.Duration `yaml:"config_watch_interval" env:"ASP_CONFIG_WATCH_INTERVAL"`
+
+	CredentialsProvider *string            `yaml:"credentials_provider" env:"ASP_CREDENTIALS_PROVIDER"`
+	RoleArn             *string            `yaml:"role_arn" env:"ASP_ROLE_ARN"`
+	Credentials         credentialsFile    `yaml:"credentials"`
+	Vault               vaultFile          `yaml:"vault"`
+	OpenId              openIdFile         `yaml:"open_id"`
+	Irsa                irsaFile           `yaml:"irsa"`
+	Sts                 stsFile            `yaml:"sts"`
+	CircuitBreaker      circuitBreakerFile `yaml:"circuit_breaker"`
+
+	UpstreamCircuitBreaker upstreamCircuitBreakerFile `yaml:"upstream_circuit_breaker"`
+	Retries                *int                       `yaml:"retries" env:"ASP_RETRIES"`
+	Retry                  retryFile                  `yaml:"retry"`
+	Failover               failoverFile               `yaml:"failover"`
+	ReadinessProbe         readinessProbeFile         `yaml:"readiness_probe"`
+
+	Log            logFile            `yaml:"log"`
+	Metrics        metricsFile        `yaml:"metrics"`
+	AccessLog      accessLogFile      `yaml:"access_log"`
+	SignatureDebug signatureDebugFile `yaml:"signature_debug"`
+
+	Server        serverFile        `yaml:"server"`
+	Transport     transportFile     `yaml:"transport"`
+	Tls           tlsFile           `yaml:"tls"`
+	UpstreamProxy upstreamProxyFile `yaml:"upstream_proxy"`
+	Shutdown      shutdownFile      `yaml:"shutdown"`
+}
+
+type credentialsFile struct {
+	AsyncFetch    *bool          `yaml:"async_fetch" env:"ASP_ASYNC_CREDENTIALS_FETCH"`
+	RefreshBefore *time.Duration `yaml:"refresh_before" env:"ASP_CREDENTIALS_REFRESH_BEFORE"`
+	RefreshJitter *time.Duration `yaml:"refresh_jitter" env:"ASP_CREDENTIALS_REFRESH_JITTER"`
+}
+
+type vaultFile struct {
+	Url                    *string                 `yaml:"url" env:"ASP_VAULT_URL"`
+	AuthToken              *string                 `yaml:"auth_token" env:"ASP_VAULT_AUTH_TOKEN"`
+	CredentialsPath        *string                 `yaml:"credentials_path" env:"ASP_VAULT_CREDENTIALS_PATH"`
+	RevokeLeasesOnShutdown *bool                   `yaml:"revoke_leases_on_shutdown" env:"ASP_VAULT_REVOKE_LEASES_ON_SHUTDOWN"`
+	CircuitBreaker         CircuitBreakerOverrides `yaml:"circuit_breaker"`
+}
+
+type openIdFile struct {
+	AuthServerUrl         *string                 `yaml:"auth_server_url" env:"ASP_OPEN_ID_AUTH_SERVER_URL"`
+	ClientId              *string                 `yaml:"client_id" env:"ASP_OPEN_ID_CLIENT_ID"`
+	ClientSecret          *string                 `yaml:"client_secret" env:"ASP_OPEN_ID_CLIENT_SECRET"`
+	Discovery             *bool                   `yaml:"discovery" env:"ASP_OPEN_ID_DISCOVERY"`
+	DiscoveryInterval     *time.Duration          `yaml:"discovery_interval" env:"ASP_OPEN_ID_DISCOVERY_INTERVAL"`
+	AsyncCredentialsFetch *bool                   `yaml:"async_credentials_fetch" env:"ASP_ASYNC_OPEN_ID_CREDENTIALS_FETCH"`
+	CircuitBreaker        CircuitBreakerOverrides `yaml:"circuit_breaker"`
+}
+
+type irsaFile struct {
+	ClientId *string `yaml:"client_id" env:"ASP_IRSA_CLIENT_ID"`
+}
+
+type stsFile struct {
+	Endpoint             *string `yaml:"endpoint" env:"ASP_STS_ENDPOINT"`
+	RegionalEndpoint     *string `yaml:"regional_endpoint" env:"ASP_STS_REGIONAL_ENDPOINT"`
+	UseFipsEndpoint      *bool   `yaml:"use_fips_endpoint" env:"ASP_STS_USE_FIPS_ENDPOINT"`
+	UseDualStackEndpoint *bool   `yaml:"use_dual_stack_endpoint" env:"ASP_STS_USE_DUAL_STACK_ENDPOINT"`
+}
+
+type circuitBreakerFile struct {
+	Timeout             *time.Duration `yaml:"timeout" env:"ASP_CIRCUIT_BREAKER_TIMEOUT"`
+	FailureThreshold    *uint32        `yaml:"failure_threshold" env:"ASP_CIRCUIT_BREAKER_FAILURE_THRESHOLD"`
+	MaxHalfOpenRequests *uint32        `yaml:"max_half_open_requests" env:"ASP_CIRCUIT_BREAKER_MAX_HALF_OPEN_REQUESTS"`
+	Interval            *time.Duration `yaml:"interval" env:"ASP_CIRCUIT_BREAKER_INTERVAL"`
+	FailureRatio        *float64       `yaml:"failure_ratio" env:"ASP_CIRCUIT_BREAKER_FAILURE_RATIO"`
+	MinRequests         *uint32        `yaml:"min_requests" env:"ASP_CIRCUIT_BREAKER_MIN_REQUESTS"`
+}
+
+type upstreamCircuitBreakerFile struct {
+	Enabled             *bool          `yaml:"enabled" env:"ASP_UPSTREAM_CIRCUIT_BREAKER"`
+	Timeout             *time.Duration `yaml:"timeout" env:"ASP_UPSTREAM_CIRCUIT_BREAKER_TIMEOUT"`
+	Interval            *time.Duration `yaml:"interval" env:"ASP_UPSTREAM_CIRCUIT_BREAKER_INTERVAL"`
+	FailureRatio        *float64       `yaml:"failure_ratio" env:"ASP_UPSTREAM_CIRCUIT_BREAKER_FAILURE_RATIO"`
+	MinRequests         *uint32        `yaml:"min_requests" env:"ASP_UPSTREAM_CIRCUIT_BREAKER_MIN_REQUESTS"`
+	MaxHalfOpenRequests *uint32        `yaml:"max_half_open_requests" env:"ASP_UPSTREAM_CIRCUIT_BREAKER_MAX_HALF_OPEN_REQUESTS"`
+	ExemptRoutes        *[]string      `yaml:"exempt_routes" env:"ASP_UPSTREAM_CIRCUIT_BREAKER_EXEMPT_ROUTES"`
+}
+
+type retryFile struct {
+	Methods        *[]string      `yaml:"methods" env:"ASP_RETRY_METHODS"`
+	SafeOperations *[]string      `yaml:"safe_operations" env:"ASP_RETRY_SAFE_OPERATIONS"`
+	MinBackoff     *time.Duration `yaml:"min_backoff" env:"ASP_RETRY_MIN_BACKOFF"`
+	MaxBackoff     *time.Duration `yaml:"max_backoff" env:"ASP_RETRY_MAX_BACKOFF"`
+	Budget         *float64       `yaml:"budget" env:"ASP_RETRY_BUDGET"`
+	BudgetRatio    *float64       `yaml:"budget_ratio" env:"ASP_RETRY_BUDGET_RATIO"`
+}
+
+type failoverFile struct {
+	// Targets are replaced by ASP_FAILOVER_TARGET_URL and ASP_FAILOVER_REGION
+	Targets          []FailoverTarget `yaml:"targets"`
+	FailureThreshold *int             `yaml:"failure_threshold" env:"ASP_FAILOVER_FAILURE_THRESHOLD"`
+	Cooldown         *time.Duration   `yaml:"cooldown" env:"ASP_FAILOVER_COOLDOWN"`
+	ProbePath        *string          `yaml:"probe_path" env:"ASP_FAILOVER_PROBE_PATH"`
+	ProbeInterval    *time.Duration   `yaml:"probe_interval" env:"ASP_FAILOVER_PROBE_INTERVAL"`
+	ProbeTimeout     *time.Duration   `yaml:"probe_timeout" env:"ASP_FAILOVER_PROBE_TIMEOUT"`
+}
+
+type readinessProbeFile struct {
+	Path    *string        `yaml:"path" env:"ASP_READINESS_PROBE_PATH"`
+	Timeout *time.Duration `yaml:"timeout" env:"ASP_READINESS_PROBE_TIMEOUT"`
+}
+
+type logFile struct {
+	Level              *string `yaml:"level" env:"ASP_LOG_LEVEL"`
+	Encoding           *string `yaml:"encoding" env:"ASP_LOG_ENCODING"`
+	SamplingInitial    *int    `yaml:"sampling_initial" env:"ASP_LOG_SAMPLING_INITIAL"`
+	SamplingThereafter *int    `yaml:"sampling_thereafter" env:"ASP_LOG_SAMPLING_THEREAFTER"`
+}
+
+type metricsFile struct {
+	Path   *string   `yaml:"path" env:"ASP_METRICS_PATH"`
+	Routes *[]string `yaml:"routes" env:"ASP_METRICS_ROUTES"`
+}
+
+type accessLogFile struct {
+	Enabled        *bool     `yaml:"enabled" env:"ASP_ACCESS_LOG"`
+	File           *string   `yaml:"file" env:"ASP_ACCESS_LOG_FILE"`
+	MaxSizeMb      *int      `yaml:"max_size_mb" env:"ASP_ACCESS_LOG_MAX_SIZE_MB"`
+	MaxBackups     *int      `yaml:"max_backups" env:"ASP_ACCESS_LOG_MAX_BACKUPS"`
+	MaxAgeDays     *int      `yaml:"max_age_days" env:"ASP_ACCESS_LOG_MAX_AGE_DAYS"`
+	SampleRate     *float64  `yaml:"sample_rate" env:"ASP_ACCESS_LOG_SAMPLE_RATE"`
+	ExcludePaths   *[]string `yaml:"exclude_paths" env:"ASP_ACCESS_LOG_EXCLUDE_PATHS"`
+	TrustedProxies *[]string `yaml:"trusted_proxies" env:"ASP_ACCESS_LOG_TRUSTED_PROXIES"`
+}
+
+type signatureDebugFile struct {
+	Enabled         *bool     `yaml:"enabled" env:"ASP_SIGNATURE_DEBUG"`
+	Header          *string   `yaml:"header" env:"ASP_SIGNATURE_DEBUG_HEADER"`
+	TrustedNetworks *[]string `yaml:"trusted_networks" env:"ASP_SIGNATURE_DEBUG_TRUSTED_NETWORKS"`
+}
+
+type serverFile struct {
+	ReadHeaderTimeout *time.Duration `yaml:"read_header_timeout" env:"ASP_SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       *time.Duration `yaml:"read_timeout" env:"ASP_SERVER_READ_TIMEOUT"`
+	WriteTimeout      *time.Duration `yaml:"write_timeout" env:"ASP_SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       *time.Duration `yaml:"idle_timeout" env:"ASP_SERVER_IDLE_TIMEOUT"`
+	MaxHeaderBytes    *int           `yaml:"max_header_bytes" env:"ASP_SERVER_MAX_HEADER_BYTES"`
+}
+
+type transportFile struct {
+	MaxIdleConns          *int           `yaml:"max_idle_conns" env:"ASP_MAX_IDLE_CONNS"`
+	MaxIdleConnsPerHost   *int           `yaml:"max_idle_conns_per_host" env:"ASP_MAX_IDLE_CONNS_PER_HOST"`
+	ResponseHeaderTimeout *time.Duration `yaml:"response_header_timeout" env:"ASP_RESPONSE_HEADER_TIMEOUT"`
+	ExpectContinueTimeout *time.Duration `yaml:"expect_continue_timeout" env:"ASP_EXPECT_CONTINUE_TIMEOUT"`
+}
+
+type tlsFile struct {
+	HandshakeTimeout *time.Duration `yaml:"handshake_timeout" env:"ASP_TLS_HANDSHAKE_TIMEOUT"`
+	CaFile           *string        `yaml:"ca_file" env:"ASP_TLS_CA_FILE"`
+	ServerName       *string        `yaml:"server_name" env:"ASP_TLS_SERVER_NAME"`
+	MinVersion       *string        `yaml:"min_version" env:"ASP_TLS_MIN_VERSION"`
+}
+
+type upstreamProxyFile struct {
+	Url      *string `yaml:"url" env:"ASP_UPSTREAM_PROXY_URL"`
+	Username *string `yaml:"username" env:"ASP_UPSTREAM_PROXY_USERNAME"`
+	Password *string `yaml:"password" env:"ASP_UPSTREAM_PROXY_PASSWORD"`
+}
+
+type shutdownFile struct {
+	Delay   *time.Duration `yaml:"delay" env:"ASP_SHUTDOWN_DELAY"`
+	Timeout *time.Duration `yaml:"timeout" env:"ASP_SHUTDOWN_TIMEOUT"`
+}
+
+// FailoverTarget is a target traffic fails over to, in the region of the target unless another one is given
+type FailoverTarget struct {
+	Url    string `yaml:"url"`
+	Region string `yaml:"region"`
+}
+
+// CircuitBreakerOverrides replace the circuit breaker settings for a single credentials provider, unset ones are kept
+type CircuitBreakerOverrides struct {
+	Timeout             *time.Duration `yaml:"timeout"`
+	FailureThreshold    *uint32        `yaml:"failure_threshold"`
+	MaxHalfOpenRequests *uint32        `yaml:"max_half_open_requests"`
+	Interval            *time.Duration `yaml:"interval"`
+	FailureRatio        *float64       `yaml:"failure_ratio"`
+	MinRequests         *uint32        `yaml:"min_requests"`
+}
+
+// applyFileOnly copies the settings which have no environment variable
+func (f *configFile) applyFileOnly(e *EnvConfig) {
+	e.FailoverTargets = f.Failover.Targets
+	e.VaultCircuitBreaker = f.Vault.CircuitBreaker
+	e.OpenIdCircuitBreaker = f.OpenId.CircuitBreaker
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"github.com/kelseyhightower/envconfig"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigFileCoversTheEnvironment(t *testing.T) {
+	var out bytes.Buffer
+	handleError(envconfig.Usagef("ASP", &EnvConfig{}, &out, "{{range .}}{{.Key}}\n{{end}}"))
+
+	fileKeys := map[string]bool{}
+	collectEnvKeys(reflect.TypeOf(configFile{}), fileKeys)
+	for _, key := range strings.Fields(out.String()) {
+		// replaced by the list of failover targets
+		if key == "ASP_FAILOVER_TARGET_URL" || key == "ASP_FAILOVER_REGION" {
+			continue
+		}
+		if !fileKeys[key] {
+			t.Errorf("expected %s to be settable in the config file", key)
+		}
+	}
+}
+
+func collectEnvKeys(fileType reflect.Type, keys map[string]bool) {
+	for i := 0; i < fileType.NumField(); i++ {
+		field := fileType.Field(i)
+		if key, ok := field.Tag.Lookup("env"); ok {
+			keys[key] = true
+		} else if field.Type.Kind() == reflect.Struct {
+			collectEnvKeys(field.Type, keys)
+		}
+	}
+}
+
+func TestConfigFileOnlySettings(t *testing.T) {
+	for _, envVar := range []string{"ASP_TARGET_URL", "ASP_CREDENTIALS_PROVIDER", "ASP_VAULT_AUTH_TOKEN", "ASP_FAILOVER_TARGET_URL", "ASP_FAILOVER_REGION", "ASP_UPSTREAM_CIRCUIT_BREAKER", "ASP_CIRCUIT_BREAKER_TIMEOUT"} {
+		t.Setenv(envVar, "")
+		os.Unsetenv(envVar)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	handleError(os.WriteFile(path, []byte(`
+version: 1
+target_url: https://search.eu-central-1.es.amazonaws.com
+credentials_provider: vault
+vault:
+  auth_token: someTokenWhichAllowsYouToAccessVault
+  circuit_breaker:
+    timeout: 10s
+circuit_breaker:
+  timeout: 30s
+upstream_circuit_breaker:
+  enabled: true
+failover:
+  targets:
+    - url: https://search.eu-west-1.es.amazonaws.com
+      region: eu-west-1
+    - url: https://search.us-east-1.es.amazonaws.com
+      region: us-east-1
+`), 0600))
+
+	e, err := readConfig(path)
+	handleError(err)
+
+	if _, ok := os.LookupEnv("ASP_VAULT_AUTH_TOKEN"); ok {
+		t.Error("expected the secrets of the config file to stay out of the environment")
+	}
+	if timeout := circuitBreakerSettings(e, e.VaultCircuitBreaker).Timeout; timeout != 10*time.Second {
+		t.Errorf("expected the circuit breaker of vault to time out after 10s, got %s", timeout)
+	}
+	if timeout := circuitBreakerSettings(e, e.OpenIdCircuitBreaker).Timeout; timeout != 30*time.Second {
+		t.Errorf("expected the other circuit breakers to time out after 30s, got %s", timeout)
+	}
+
+	targetURL, _ := url.Parse(e.TargetUrl)
+	targets, err := newTargetGroup(e, targetURL, "eu-central-1")
+	handleError(err)
+	var names []string
+	for _, target := range targets.Targets() {
+		names = append(names, target.CircuitBreaker().Name())
+	}
+	if strings.Join(names, ",") != "upstream,failover,failover-2" {
+		t.Errorf("expected a target with its own circuit breaker for every failover target, got %v", names)
+	}
+
+	// the environment replaces the failover targets of the file
+	t.Setenv("ASP_FAILOVER_TARGET_URL", "https://search.eu-north-1.es.amazonaws.com")
+	e, err = readConfig(path)
+	handleError(err)
+	if targets := failoverTargets(e); len(targets) != 1 || targets[0].Url != "https://search.eu-north-1.es.amazonaws.com" {
+		t.Errorf("expected ASP_FAILOVER_TARGET_URL to replace the failover targets, got %v", targets)
+	}
+}
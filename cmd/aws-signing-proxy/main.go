@@ -1,26 +1,34 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/go-co-op/gocron"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
 	"github.com/idealo/aws-signing-proxy/pkg/irsa"
 	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/idealo/aws-signing-proxy/pkg/mgmt"
 	"github.com/idealo/aws-signing-proxy/pkg/oidc"
 	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/idealo/aws-signing-proxy/pkg/refresher"
+	"github.com/idealo/aws-signing-proxy/pkg/tracing"
 	"github.com/idealo/aws-signing-proxy/pkg/vault"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 type EnvConfig struct {
-	TargetUrl                   string        `required:"true" split_words:"true"`
+	TargetUrl                   string        `split_words:"true"`
 	Port                        int           `default:"8080"`
 	MgmtPort                    int           `split_words:"true" default:"8081"`
 	Service                     string        `default:"es"`
@@ -31,24 +39,250 @@ type EnvConfig struct {
 	OpenIdAuthServerUrl         string        `split_words:"true"`
 	OpenIdClientId              string        `split_words:"true"`
 	OpenIdClientSecret          string        `split_words:"true"`
+	OpenIdDiscovery             bool          `split_words:"true" default:"false"`
+	OpenIdDiscoveryInterval     time.Duration `split_words:"true" default:"1h"`
 	AsyncOpenIdCredentialsFetch bool          `split_words:"true" default:"false"`
+	AsyncCredentialsFetch       bool          `split_words:"true" default:"false"`
+	CredentialsRefreshBefore    time.Duration `split_words:"true" default:"4m"`
+	CredentialsRefreshJitter    time.Duration `split_words:"true" default:"30s"`
 	RoleArn                     string        `split_words:"true"`
 	MetricsPath                 string        `split_words:"true" default:"/status/metrics"`
+	MetricsRoutes               []string      `split_words:"true"`
 	FlushInterval               time.Duration `split_words:"true" default:"0s"`
 	IdleConnTimeout             time.Duration `split_words:"true" default:"90s"`
 	DialTimeout                 time.Duration `split_words:"true"  default:"30s"`
 	IrsaClientId                string        `split_words:"true" default:"aws-signing-proxy"`
+	ReadinessProbePath          string        `split_words:"true"`
+	ReadinessProbeTimeout       time.Duration `split_words:"true" default:"5s"`
+	AdminToken                  string        `split_words:"true"`
+	LogLevel                    string        `split_words:"true" default:"info"`
+	LogEncoding                 string        `split_words:"true" default:"json"`
+	LogSamplingInitial          int           `split_words:"true" default:"100"`
+	LogSamplingThereafter       int           `split_words:"true" default:"100"`
+
+	CircuitBreakerTimeout             time.Duration `split_words:"true" default:"60s"`
+	CircuitBreakerFailureThreshold    uint32        `split_words:"true" default:"5"`
+	CircuitBreakerMaxHalfOpenRequests uint32        `split_words:"true" default:"1"`
+	CircuitBreakerInterval            time.Duration `split_words:"true" default:"0s"`
+	CircuitBreakerFailureRatio        float64       `split_words:"true" default:"0"`
+	CircuitBreakerMinRequests         uint32        `split_words:"true" default:"10"`
+
+	UpstreamCircuitBreaker                    bool          `split_words:"true" default:"false"`
+	UpstreamCircuitBreakerTimeout             time.Duration `split_words:"true" default:"30s"`
+	UpstreamCircuitBreakerInterval            time.Duration `split_words:"true" default:"10s"`
+	UpstreamCircuitBreakerFailureRatio        float64       `split_words:"true" default:"0.5"`
+	UpstreamCircuitBreakerMinRequests         uint32        `split_words:"true" default:"20"`
+	UpstreamCircuitBreakerMaxHalfOpenRequests uint32        `split_words:"true" default:"5"`
+	UpstreamCircuitBreakerExemptRoutes        []string      `split_words:"true"`
+
+	Retries             int           `default:"0"`
+	RetryMethods        []string      `split_words:"true" default:"GET,HEAD,OPTIONS,PUT,DELETE"`
+	RetrySafeOperations []string      `split_words:"true"`
+	RetryMinBackoff     time.Duration `split_words:"true" default:"100ms"`
+	RetryMaxBackoff     time.Duration `split_words:"true" default:"5s"`
+	RetryBudget         float64       `split_words:"true" default:"10"`
+	RetryBudgetRatio    float64       `split_words:"true" default:"0.1"`
+
+	FailoverTargetUrl        string        `split_words:"true"`
+	FailoverRegion           string        `split_words:"true"`
+	FailoverFailureThreshold int           `split_words:"true" default:"3"`
+	FailoverCooldown         time.Duration `split_words:"true" default:"30s"`
+	FailoverProbePath        string        `split_words:"true"`
+	FailoverProbeInterval    time.Duration `split_words:"true" default:"10s"`
+	FailoverProbeTimeout     time.Duration `split_words:"true" default:"5s"`
+
+	AccessLog               bool     `split_words:"true" default:"false"`
+	AccessLogFile           string   `split_words:"true"`
+	AccessLogMaxSizeMb      int      `split_words:"true" default:"100"`
+	AccessLogMaxBackups     int      `split_words:"true" default:"5"`
+	AccessLogMaxAgeDays     int      `split_words:"true" default:"7"`
+	AccessLogSampleRate     float64  `split_words:"true" default:"1"`
+	AccessLogExcludePaths   []string `split_words:"true"`
+	AccessLogTrustedProxies []string `split_words:"true"`
+
+	SignatureDebug                bool     `split_words:"true" default:"false"`
+	SignatureDebugHeader          string   `split_words:"true" default:"X-Asp-Debug-Signature"`
+	SignatureDebugTrustedNetworks []string `split_words:"true" default:"127.0.0.0/8,::1/128"`
+
+	ConfigWatchInterval time.Duration `split_words:"true" default:"5s"`
+
+	ServerReadHeaderTimeout time.Duration `split_words:"true" default:"10s"`
+	ServerReadTimeout       time.Duration `split_words:"true" default:"0s"`
+	ServerWriteTimeout      time.Duration `split_words:"true" default:"0s"`
+	ServerIdleTimeout       time.Duration `split_words:"true" default:"120s"`
+	ServerMaxHeaderBytes    int           `split_words:"true" default:"1048576"`
+	MaxRequestBodyBytes     int64         `split_words:"true" default:"0"`
+
+	MaxIdleConns          int           `split_words:"true" default:"100"`
+	MaxIdleConnsPerHost   int           `split_words:"true" default:"100"`
+	ResponseHeaderTimeout time.Duration `split_words:"true" default:"0s"`
+	ExpectContinueTimeout time.Duration `split_words:"true" default:"1s"`
+	TlsHandshakeTimeout   time.Duration `split_words:"true" default:"10s"`
+	TlsCaFile             string        `split_words:"true"`
+	TlsServerName         string        `split_words:"true"`
+	TlsMinVersion         string        `split_words:"true" default:"1.2"`
+	UpstreamProxyUrl      string        `split_words:"true"`
+	UpstreamProxyUsername string        `split_words:"true"`
+	UpstreamProxyPassword string        `split_words:"true"`
+
+	StsEndpoint             string `split_words:"true"`
+	StsRegionalEndpoint     string `split_words:"true"`
+	StsUseFipsEndpoint      bool   `split_words:"true" default:"false"`
+	StsUseDualStackEndpoint bool   `split_words:"true" default:"false"`
+
+	ShutdownDelay               time.Duration `split_words:"true" default:"5s"`
+	ShutdownTimeout             time.Duration `split_words:"true" default:"20s"`
+	VaultRevokeLeasesOnShutdown bool          `split_words:"true" default:"true"`
+
+	// only available in the config file
+	FailoverTargets      []FailoverTarget        `ignored:"true"`
+	VaultCircuitBreaker  CircuitBreakerOverrides `ignored:"true"`
+	OpenIdCircuitBreaker CircuitBreakerOverrides `ignored:"true"`
+}
+
+type circuitBreakerClient interface {
+	CircuitBreaker() *circuitbreaker.CircuitBreaker
+}
+
+type leaseRevoker interface {
+	RevokeLeases(ctx context.Context) error
 }
 
 func main() {
 
-	defer Logger.Sync()
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:], os.Stdout))
+	}
 
 	e := loadConfig()
 
+	err := ConfigureLogging(LogConfig{
+		Level:              e.LogLevel,
+		Encoding:           e.LogEncoding,
+		SamplingInitial:    e.LogSamplingInitial,
+		SamplingThereafter: e.LogSamplingThereafter,
+	})
+	if err != nil {
+		Logger.Fatal("Invalid logging configuration", zap.Error(err))
+	}
+	defer Logger.Sync()
+
+	registerSecrets(e)
+
+	if tracing.Enabled() {
+		shutdown, err := tracing.Init(context.Background())
+		if err != nil {
+			Logger.Fatal("Could not set up tracing", zap.Error(err))
+		}
+		defer shutdown(context.Background())
+	}
+
+	current, err := newInstance(e)
+	if err != nil {
+		Logger.Fatal("Could not set up the proxy", zap.Error(err))
+	}
+	handlers := newSwappableHandlers(current)
+
+	listenString := fmt.Sprintf(":%v", e.Port)
+	mgmtPortString := fmt.Sprintf(":%v", e.MgmtPort)
+	Logger.Info("Listening", zap.String("port", listenString))
+	Logger.Info("Forwarding traffic", zap.String("target", e.TargetUrl))
+
+	mgmtServer := newServer(e, mgmtPortString, newMgmtHandler(e.MetricsPath, handlers.mgmtHandlers()))
+	go serve(mgmtServer)
+
+	reloader := newReloader(os.Getenv("ASP_CONFIG_FILE"), e, handlers)
+	reloader.watch(e.ConfigWatchInterval)
+
+	server := newServer(e, listenString, handlers)
+	go serve(server)
+
+	awaitShutdown(server, mgmtServer, reloader, handlers)
+}
+
+// instance is everything built from one configuration. It is replaced as a whole when the configuration is reloaded.
+type instance struct {
+	config       EnvConfig
+	handler      http.Handler
+	mgmtHandlers map[string]http.Handler
+	readiness    *mgmt.ReadinessHandler
+	closers      []func()
+	// shutdownHooks run when the proxy shuts down or once the replaced instance is drained after a reload
+	shutdownHooks []func(ctx context.Context) error
+
+	// inFlight counts the requests served by the instance, idle is closed once it is retired and they finished
+	mutex    sync.Mutex
+	inFlight int
+	retired  bool
+	idle     chan struct{}
+}
+
+// acquire counts a request served by the instance, it fails once the instance has been retired
+func (i *instance) acquire() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.retired {
+		return false
+	}
+	i.inFlight++
+	return true
+}
+
+func (i *instance) release() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.inFlight--
+	if i.retired && i.inFlight == 0 {
+		close(i.idle)
+	}
+}
+
+// drain retires the instance and waits until its requests in flight finished, at most for the timeout
+func (i *instance) drain(timeout time.Duration) {
+	i.mutex.Lock()
+	i.retired = true
+	i.idle = make(chan struct{})
+	if i.inFlight == 0 {
+		close(i.idle)
+	}
+	i.mutex.Unlock()
+
+	select {
+	case <-i.idle:
+	case <-time.After(timeout):
+		Logger.Warn("Requests in flight of the replaced configuration did not finish in time", zap.Duration("timeout", timeout))
+	}
+}
+
+// close stops the background tasks of the instance, e.g. schedulers and credential refreshers
+func (i *instance) close() {
+	for _, closer := range i.closers {
+		closer()
+	}
+}
+
+// shutdown closes the instance and cleans up behind it, e.g. revokes the Vault leases
+func (i *instance) shutdown(ctx context.Context) {
+	i.close()
+	for _, hook := range i.shutdownHooks {
+		if err := hook(ctx); err != nil {
+			Logger.Warn("Cleaning up on shutdown failed", zap.Error(err))
+		}
+	}
+}
+
+func newInstance(e EnvConfig) (_ *instance, err error) {
+	i := &instance{config: e}
+	defer func() {
+		// stop the background tasks and close the files of a half built instance
+		if err != nil {
+			i.close()
+		}
+	}()
+
 	targetURL, err := url.Parse(e.TargetUrl)
 	if err != nil {
-		Logger.Error(err.Error())
+		return nil, err
 	}
 
 	// Region order of precedent:
@@ -58,144 +292,421 @@ func main() {
 		region = "eu-central-1"
 	}
 
+	transportConfig, err := newTransportConfig(e)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := newHttpClient(e, transportConfig)
+	stsConfig, err := newStsConfig(e, httpClient)
+	if err != nil {
+		return nil, err
+	}
+
 	var client proxy.ReadClient
 
 	switch e.CredentialsProvider {
 	case "irsa":
-		client = newIrsaClient(e, client, region)
+		client = newIrsaClient(e, client, region, stsConfig)
 	case "oidc":
-		client = newOidcClient(e, client, region)
+		var scheduler *gocron.Scheduler
+		client, scheduler = newOidcClient(e, client, region, httpClient, stsConfig)
+		if scheduler != nil {
+			i.closers = append(i.closers, scheduler.Stop)
+		}
 	case "vault":
-		client = newVaultClient(e, client)
+		client = newVaultClient(e, client, httpClient)
 	default:
 		Logger.Warn("Using static credentials is unsafe. Please consider using some short-living credentials mechanism like IRSA, OIDC or Vault.")
 	}
 
+	var breaker *circuitbreaker.CircuitBreaker
+	if cbClient, ok := client.(circuitBreakerClient); ok {
+		breaker = cbClient.CircuitBreaker()
+	}
+	if revoker, ok := client.(leaseRevoker); ok && e.VaultRevokeLeasesOnShutdown {
+		i.shutdownHooks = append(i.shutdownHooks, revoker.RevokeLeases)
+	}
+
+	if client != nil && (e.AsyncCredentialsFetch || (e.AsyncOpenIdCredentialsFetch && e.CredentialsProvider == "oidc")) {
+		r := newRefresher(e, client)
+		i.closers = append(i.closers, r.Stop)
+		client = r
+	}
+
+	credentials := proxy.NewCredentials(client)
+
+	var upstreamBreaker *circuitbreaker.CircuitBreaker
+	var targets *proxy.TargetGroup
+	if len(failoverTargets(e)) > 0 {
+		targets, err = newTargetGroup(e, targetURL, region)
+		if err != nil {
+			return nil, err
+		}
+	} else if e.UpstreamCircuitBreaker {
+		upstreamBreaker = newUpstreamCircuitBreaker(e, "upstream")
+	}
+
+	trustedNetworks, err := parseNetworks(e.SignatureDebugTrustedNetworks)
+	if err != nil {
+		return nil, err
+	}
 	signingProxy := proxy.NewSigningProxy(proxy.Config{
-		Target:          targetURL,
-		Region:          region,
-		Service:         e.Service,
-		FlushInterval:   e.FlushInterval,
-		IdleConnTimeout: e.IdleConnTimeout,
-		DialTimeout:     e.DialTimeout,
-		AuthClient:      client,
+		Target:                      targetURL,
+		Region:                      region,
+		Service:                     e.Service,
+		FlushInterval:               e.FlushInterval,
+		IdleConnTimeout:             e.IdleConnTimeout,
+		DialTimeout:                 e.DialTimeout,
+		AuthClient:                  client,
+		Credentials:                 credentials,
+		UpstreamBreaker:             upstreamBreaker,
+		UpstreamBreakerExemptRoutes: proxy.NewRoutes(e.UpstreamCircuitBreakerExemptRoutes),
+		Retry: proxy.RetryPolicy{
+			Retries:        e.Retries,
+			Methods:        e.RetryMethods,
+			SafeOperations: e.RetrySafeOperations,
+			MinBackoff:     e.RetryMinBackoff,
+			MaxBackoff:     e.RetryMaxBackoff,
+			Budget:         e.RetryBudget,
+			BudgetRatio:    e.RetryBudgetRatio,
+		},
+		Targets:                       targets,
+		SignatureDebug:                e.SignatureDebug,
+		SignatureDebugHeader:          e.SignatureDebugHeader,
+		SignatureDebugTrustedNetworks: trustedNetworks,
+		Transport:                     transportConfig,
 	})
 
-	listenString := fmt.Sprintf(":%v", e.Port)
-	mgmtPortString := fmt.Sprintf(":%v", e.MgmtPort)
-	Logger.Info("Listening", zap.String("port", listenString))
-	Logger.Info("Forwarding traffic", zap.String("target", targetURL.String()))
+	if targets != nil && e.FailoverProbePath != "" {
+		i.closers = append(i.closers, scheduleTargetProbes(e, targets).Stop)
+	}
 
-	go provideMgmtEndpoint(mgmtPortString, e.MetricsPath)
+	checks := []mgmt.Check{mgmt.CredentialsCheck(credentials)}
+	if breaker != nil {
+		checks = append(checks, mgmt.CircuitBreakerCheck(breaker))
+	}
+	upstreamBreakers := []*circuitbreaker.CircuitBreaker{upstreamBreaker}
+	if targets != nil {
+		upstreamBreakers = nil
+		for _, target := range targets.Targets() {
+			upstreamBreakers = append(upstreamBreakers, target.CircuitBreaker())
+		}
+	}
+	for _, upstreamBreaker := range upstreamBreakers {
+		if upstreamBreaker != nil {
+			upstreamCheck := mgmt.CircuitBreakerCheck(upstreamBreaker)
+			upstreamCheck.Name = upstreamBreaker.Name() + "_circuit_breaker"
+			checks = append(checks, upstreamCheck)
+		}
+	}
+	if e.ReadinessProbePath != "" {
+		probeUrl := targetURL.ResolveReference(&url.URL{Path: e.ReadinessProbePath})
+		checks = append(checks, mgmt.UpstreamCheck(signingProxy.Transport, probeUrl.String(), e.ReadinessProbeTimeout))
+	}
 
-	err = http.ListenAndServe(listenString, signingProxy)
-	Logger.Error("Something went wrong", zap.Error(err))
+	i.readiness = mgmt.NewReadinessHandler(checks...)
+	i.mgmtHandlers = map[string]http.Handler{
+		"/status/ready":    i.readiness,
+		"/status/identity": mgmt.NewIdentityHandler(credentials, e.CredentialsProvider, region, stsConfig),
+	}
+	if e.AdminToken != "" {
+		i.mgmtHandlers["/admin/"] = mgmt.NewAdminHandler(e.AdminToken, credentials, breaker)
+	}
 
+	routes := proxy.NewRoutes(e.MetricsRoutes)
+
+	handler := proxy.InstrumentHandler(proxy.LimitRequestBody(signingProxy, e.MaxRequestBodyBytes), routes)
+	if e.AccessLog {
+		var accessLog *proxy.AccessLog
+		accessLog, err = newAccessLog(e)
+		if err != nil {
+			return nil, err
+		}
+		i.closers = append(i.closers, func() { _ = accessLog.Close() })
+		handler = accessLog.Handler(handler)
+	}
+	if tracing.Enabled() {
+		handler = proxy.TraceHandler(handler, routes)
+	}
+	i.handler = handler
+	return i, nil
 }
 
 func loadConfig() EnvConfig {
-	e, err := parseEnvironmentVariables()
+	e, err := parseConfig(os.Getenv("ASP_CONFIG_FILE"))
 	if err != nil {
-		Logger.Error(err.Error())
+		Logger.Fatal("Invalid configuration", zap.Error(err))
 	}
 
 	// Validate target URL
 	if anyEnvVarEmpty(e.Service, e.TargetUrl) {
 		Logger.Fatal("required parameter target (e.g. foo.eu-central-1.es.amazonaws.com) OR service (e.g. es) missing!")
 	}
+	if err := validateConfig(e); err != nil {
+		Logger.Fatal("Invalid configuration", zap.Error(err))
+	}
 	return e
 }
 
-func parseEnvironmentVariables() (EnvConfig, error) {
-	var e EnvConfig
-	err := envconfig.Process("ASP", &e)
+// registerSecrets makes sure the configured secrets never show up in logs
+func registerSecrets(e EnvConfig) {
+	for _, secret := range []string{e.VaultAuthToken, e.OpenIdClientSecret, e.AdminToken, e.UpstreamProxyPassword} {
+		RegisterSecret(secret)
+	}
+	if proxyURL, err := url.Parse(e.UpstreamProxyUrl); err == nil && proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		RegisterSecret(password)
+	}
+}
 
+// parseConfig reads the config file, if any, with the environment on top and checks the required settings
+func parseConfig(path string) (EnvConfig, error) {
+	e, err := readConfig(path)
 	if err != nil {
 		return e, err
 	}
 
-	switch e.CredentialsProvider {
+	if e.TargetUrl == "" {
+		return e, errors.New("required key ASP_TARGET_URL missing value")
+	}
+	if missing := missingSettings(e); len(missing) > 0 {
+		return e, fmt.Errorf("required key %s missing value", missing[0])
+	}
+	return e, nil
+}
 
-	case "oidc":
-		err = assertEnvVarsAreSet([]string{"ASP_OPEN_ID_AUTH_SERVER_URL", "ASP_OPEN_ID_CLIENT_ID", "ASP_OPEN_ID_CLIENT_SECRET", "ASP_ROLE_ARN"})
-		break
-	case "vault":
-		err = assertEnvVarsAreSet([]string{"ASP_VAULT_URL", "ASP_VAULT_PATH", "ASP_VAULT_AUTH_TOKEN"})
-		break
-	case "irsa":
-		err = assertEnvVarsAreSet([]string{"ASP_IRSA_CLIENT_ID", "ASP_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"})
-		break
-	default:
-		break
+// circuitBreakerSettings returns the settings of the circuit breaker guarding a credentials provider, with the overrides of that provider
+func circuitBreakerSettings(e EnvConfig, overrides CircuitBreakerOverrides) circuitbreaker.Settings {
+	settings := circuitbreaker.Settings{
+		Timeout:             e.CircuitBreakerTimeout,
+		MaxHalfOpenRequests: e.CircuitBreakerMaxHalfOpenRequests,
+		Interval:            e.CircuitBreakerInterval,
+		FailureThreshold:    e.CircuitBreakerFailureThreshold,
+		FailureRatio:        e.CircuitBreakerFailureRatio,
+		MinRequests:         e.CircuitBreakerMinRequests,
+	}
+	if overrides.Timeout != nil {
+		settings.Timeout = *overrides.Timeout
+	}
+	if overrides.MaxHalfOpenRequests != nil {
+		settings.MaxHalfOpenRequests = *overrides.MaxHalfOpenRequests
+	}
+	if overrides.Interval != nil {
+		settings.Interval = *overrides.Interval
 	}
+	if overrides.FailureThreshold != nil {
+		settings.FailureThreshold = *overrides.FailureThreshold
+	}
+	if overrides.FailureRatio != nil {
+		settings.FailureRatio = *overrides.FailureRatio
+	}
+	if overrides.MinRequests != nil {
+		settings.MinRequests = *overrides.MinRequests
+	}
+	return settings
+}
 
-	return e, err
+// failoverTargets returns the targets traffic fails over to in order, ASP_FAILOVER_TARGET_URL replaces the ones of the config file
+func failoverTargets(e EnvConfig) []FailoverTarget {
+	if e.FailoverTargetUrl != "" {
+		return []FailoverTarget{{Url: e.FailoverTargetUrl, Region: e.FailoverRegion}}
+	}
+	return e.FailoverTargets
 }
 
-func assertEnvVarsAreSet(envVars []string) error {
-	for _, condParam := range envVars {
-		if len(strings.TrimSpace(os.Getenv(condParam))) == 0 {
-			return errors.New(fmt.Sprintf("required key %s missing value", condParam))
+// parseNetworks parses CIDR notations as well as single addresses
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
 		}
+		parsed = append(parsed, ipNet)
 	}
-	return nil
+	return parsed, nil
 }
 
-func newVaultClient(e EnvConfig, client proxy.ReadClient) proxy.ReadClient {
+func newAccessLog(e EnvConfig) (*proxy.AccessLog, error) {
+	trustedProxies, err := parseNetworks(e.AccessLogTrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	accessLog := proxy.NewAccessLog().
+		WithSampleRate(e.AccessLogSampleRate).
+		WithExcludePaths(e.AccessLogExcludePaths).
+		WithTrustedProxies(trustedProxies)
+	if e.AccessLogFile != "" {
+		accessLog = accessLog.WithFile(e.AccessLogFile, e.AccessLogMaxSizeMb, e.AccessLogMaxBackups, e.AccessLogMaxAgeDays)
+	}
+	return accessLog, nil
+}
+
+func newTargetGroup(e EnvConfig, targetURL *url.URL, region string) (*proxy.TargetGroup, error) {
+	primary := proxy.NewTarget(targetURL, region)
+	if e.UpstreamCircuitBreaker {
+		// one breaker per target, so an overloaded target does not stop the traffic to the other ones
+		primary.WithCircuitBreaker(newUpstreamCircuitBreaker(e, "upstream"))
+	}
+	targets := []*proxy.Target{primary}
+
+	for i, failoverTarget := range failoverTargets(e) {
+		failoverURL, err := url.Parse(failoverTarget.Url)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing the failover target url: %w", err)
+		}
+		failoverRegion := failoverTarget.Region
+		if failoverRegion == "" {
+			failoverRegion = e.FailoverRegion
+		}
+		if failoverRegion == "" {
+			failoverRegion = region
+		}
+
+		Logger.Info("Failing over to secondary target.", zap.String("target", failoverURL.String()), zap.String("region", failoverRegion))
+		secondary := proxy.NewTarget(failoverURL, failoverRegion)
+		if e.UpstreamCircuitBreaker {
+			name := "failover"
+			if i > 0 {
+				name = fmt.Sprintf("failover-%d", i+1)
+			}
+			secondary.WithCircuitBreaker(newUpstreamCircuitBreaker(e, name))
+		}
+		targets = append(targets, secondary)
+	}
+	return proxy.NewTargetGroup(targets...).
+		WithFailureThreshold(e.FailoverFailureThreshold).
+		WithCooldown(e.FailoverCooldown), nil
+}
+
+func scheduleTargetProbes(e EnvConfig, targets *proxy.TargetGroup) *gocron.Scheduler {
+	scheduler := gocron.NewScheduler(time.UTC)
+	_, err := scheduler.Every(e.FailoverProbeInterval).StartImmediately().Do(func() {
+		targets.Probe(e.FailoverProbePath, e.FailoverProbeTimeout)
+	})
+
+	if err != nil {
+		Logger.Error("Scheduled Task for probing the targets failed", zap.Error(err))
+	}
+	scheduler.StartAsync()
+	return scheduler
+}
+
+// newUpstreamCircuitBreaker creates the breaker guarding a target, which only trips on the ratio of failed requests
+func newUpstreamCircuitBreaker(e EnvConfig, name string) *circuitbreaker.CircuitBreaker {
+	Logger.Info("Using circuit breaker for the target.", zap.String("name", name), zap.Float64("failure-ratio", e.UpstreamCircuitBreakerFailureRatio))
+	return circuitbreaker.NewUpstreamCircuitBreaker(name, circuitbreaker.Settings{
+		Timeout:             e.UpstreamCircuitBreakerTimeout,
+		MaxHalfOpenRequests: e.UpstreamCircuitBreakerMaxHalfOpenRequests,
+		Interval:            e.UpstreamCircuitBreakerInterval,
+		FailureThreshold:    math.MaxUint32,
+		FailureRatio:        e.UpstreamCircuitBreakerFailureRatio,
+		MinRequests:         e.UpstreamCircuitBreakerMinRequests,
+	})
+}
+
+func newVaultClient(e EnvConfig, client proxy.ReadClient, httpClient *http.Client) proxy.ReadClient {
 	Logger.Info("Using Credentials from Vault.", zap.String("vault-url", e.VaultUrl), zap.String("path", e.VaultCredentialsPath))
 	client = vault.NewVaultClient().
+		WithHttpClient(httpClient).
 		WithBaseUrl(e.VaultUrl).
 		WithToken(e.VaultAuthToken).
+		WithCircuitBreakerSettings(circuitBreakerSettings(e, e.VaultCircuitBreaker)).
 		ReadFrom(e.VaultCredentialsPath)
 	return client
 }
 
-func newIrsaClient(e EnvConfig, client proxy.ReadClient, region string) proxy.ReadClient {
-	client = irsa.NewIRSAClient(region, e.IrsaClientId, e.RoleArn)
+func newIrsaClient(e EnvConfig, client proxy.ReadClient, region string, stsConfig *aws.Config) proxy.ReadClient {
+	client = irsa.NewIRSAClient(region, e.IrsaClientId, e.RoleArn, stsConfig)
 	return client
 }
 
-func newOidcClient(e EnvConfig, client proxy.ReadClient, region string) proxy.ReadClient {
+// newOidcClient returns the scheduler refreshing the discovery document if discovery is enabled
+func newOidcClient(e EnvConfig, client proxy.ReadClient, region string, httpClient *http.Client, stsConfig *aws.Config) (proxy.ReadClient, *gocron.Scheduler) {
 
-	var oidcClient oidc.ReadClient
-	oidcClient = *oidc.NewOIDCClient(region).
-		WithAuthServerUrl(e.OpenIdAuthServerUrl).
+	oidcClient := oidc.NewOIDCClient(region, stsConfig).
+		WithHttpClient(httpClient).
 		WithClientSecret(e.OpenIdClientSecret).
 		WithClientId(e.OpenIdClientId).
 		WithRoleArn(e.RoleArn).
-		Build()
+		WithCircuitBreakerSettings(circuitBreakerSettings(e, e.OpenIdCircuitBreaker))
+
+	if e.OpenIdDiscovery {
+		oidcClient = oidcClient.WithIssuerUrl(e.OpenIdAuthServerUrl)
+	} else {
+		oidcClient = oidcClient.WithAuthServerUrl(e.OpenIdAuthServerUrl)
+	}
+	oidcClient = oidcClient.Build()
 
-	if e.AsyncOpenIdCredentialsFetch == true {
-		scheduler := gocron.NewScheduler(time.UTC)
-		_, err := scheduler.Every(10).Seconds().StartImmediately().Do(func() {
-			err := oidc.RetrieveCredentials(&oidcClient)
+	var scheduler *gocron.Scheduler
+	if e.OpenIdDiscovery {
+		scheduler = gocron.NewScheduler(time.UTC)
+		_, err := scheduler.Every(e.OpenIdDiscoveryInterval).StartImmediately().Do(func() {
+			err := oidcClient.RefreshDiscovery()
 			if err != nil {
-				Logger.Error("Something went wrong while trying to retrieve credentials", zap.Error(err))
+				Logger.Error("Something went wrong while trying to refresh the OpenID Connect discovery document", zap.Error(err))
 			}
 		})
 
 		if err != nil {
-			Logger.Error("Scheduled Task for retrieving refreshed OIDC credentials failed", zap.Error(err))
+			Logger.Error("Scheduled Task for refreshing the OpenID Connect discovery document failed", zap.Error(err))
 		}
 		scheduler.StartAsync()
 	}
 
-	client = &oidcClient
+	client = oidcClient
 	Logger.Info("Using Credentials from from OIDC with Oauth2 server", zap.String("auth-server", e.OpenIdAuthServerUrl))
-	return client
+	return client, scheduler
 }
 
-func provideMgmtEndpoint(mgmtPort string, metricsPath string) {
+func newRefresher(e EnvConfig, client proxy.ReadClient) *refresher.Refresher {
+	r := refresher.NewRefresher(client).
+		WithName(e.CredentialsProvider).
+		WithRefreshBefore(e.CredentialsRefreshBefore).
+		WithJitter(e.CredentialsRefreshJitter)
+	r.Start()
+
+	Logger.Info("Refreshing credentials asynchronously", zap.String("provider", e.CredentialsProvider))
+	return r
+}
 
-	http.HandleFunc("/status/health", func(w http.ResponseWriter, request *http.Request) {
+// newServer guards the listener against slow or oversized requests, e.g. slowloris attacks
+func newServer(e EnvConfig, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: e.ServerReadHeaderTimeout,
+		ReadTimeout:       e.ServerReadTimeout,
+		WriteTimeout:      e.ServerWriteTimeout,
+		IdleTimeout:       e.ServerIdleTimeout,
+		MaxHeaderBytes:    e.ServerMaxHeaderBytes,
+	}
+}
+
+func newMgmtHandler(metricsPath string, handlers map[string]http.Handler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status/health", func(w http.ResponseWriter, request *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		_, _ = w.Write([]byte("{\"status\":\"ok\"}"))
 	})
 
-	http.Handle(metricsPath, promhttp.Handler())
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, handler)
+	}
+
+	mux.Handle(metricsPath, promhttp.Handler())
 
-	zap.S().Fatal(http.ListenAndServe(mgmtPort, nil))
+	return mux
 }
 
 func anyEnvVarEmpty(vars ...string) bool {
@@ -6,8 +6,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -75,6 +77,12 @@ func TestBasicMainIntegrationTest(t *testing.T) {
 		t.Fatalf("Prometheus Metrics endpoint is broken!\nWanted: HTTP Status Code 200\nGot: HTTP Status Code %d", resp.StatusCode)
 	}
 
+	// Static credentials are present, so the proxy is ready
+	resp, err = client.Get("http://127.0.0.1:8081/status/ready")
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Readiness endpoint is broken!\nWanted: HTTP Status Code 200\nGot: %v", resp)
+	}
+
 }
 
 func TestRequiredParamsAreChecked(t *testing.T) {
@@ -91,7 +99,7 @@ func TestRequiredParamsAreChecked(t *testing.T) {
 
 			os.Unsetenv(tc.envVarName)
 
-			_, err := parseEnvironmentVariables()
+			_, err := parseConfig("")
 			if tc.required {
 				if err == nil || err.Error() != fmt.Sprintf("required key %s missing value", tc.envVarName) {
 					t.Fatal(fmt.Sprintf("Fail: omitting the required parameter %s did not lead to a parsing failure.", tc.envVarName))
@@ -129,7 +137,7 @@ func TestRequiredParamsForOIDCAreChecked(t *testing.T) {
 
 			os.Unsetenv(tc.envVarName)
 
-			_, err := parseEnvironmentVariables()
+			_, err := parseConfig("")
 			if tc.required {
 				if err == nil || err.Error() != fmt.Sprintf("required key %s missing value", tc.envVarName) {
 					t.Fatal(fmt.Sprintf("Fail: omitting the required parameter %s did not lead to a parsing failure.", tc.envVarName))
@@ -147,7 +155,7 @@ func TestRequiredParamsForOIDCAreChecked(t *testing.T) {
 func TestRequiredParamsForVaultAreChecked(t *testing.T) {
 	requiredParams := []string{
 		"ASP_VAULT_URL",
-		"ASP_VAULT_PATH",
+		"ASP_VAULT_CREDENTIALS_PATH",
 		"ASP_VAULT_AUTH_TOKEN",
 	}
 
@@ -157,12 +165,12 @@ func TestRequiredParamsForVaultAreChecked(t *testing.T) {
 			os.Setenv("ASP_CREDENTIALS_PROVIDER", "vault")
 
 			os.Setenv("ASP_VAULT_URL", "FOORL")
-			os.Setenv("ASP_VAULT_PATH", "/foo/bar")
+			os.Setenv("ASP_VAULT_CREDENTIALS_PATH", "/foo/bar")
 			os.Setenv("ASP_VAULT_AUTH_TOKEN", "secret")
 
 			os.Unsetenv(rp)
 
-			_, err := parseEnvironmentVariables()
+			_, err := parseConfig("")
 			if err == nil || err.Error() != fmt.Sprintf("required key %s missing value", rp) {
 				t.Fatal(fmt.Sprintf("Fail: omitting the required parameter %s did not lead to a parsing failure.", rp))
 			}
@@ -172,7 +180,6 @@ func TestRequiredParamsForVaultAreChecked(t *testing.T) {
 
 func TestRequiredParamsForIrsaAreChecked(t *testing.T) {
 	requiredParams := []string{
-		"ASP_IRSA_CLIENT_ID",
 		"AWS_WEB_IDENTITY_TOKEN_FILE",
 		"ASP_ROLE_ARN",
 	}
@@ -182,13 +189,12 @@ func TestRequiredParamsForIrsaAreChecked(t *testing.T) {
 			os.Setenv("ASP_TARGET_URL", "http://127.0.0.1:1337")
 			os.Setenv("ASP_CREDENTIALS_PROVIDER", "irsa")
 
-			os.Setenv("ASP_IRSA_CLIENT_ID", "FOO")
 			os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/foo/bar")
 			os.Setenv("ASP_ROLE_ARN", "FOO::ARN")
 
 			os.Unsetenv(rp)
 
-			_, err := parseEnvironmentVariables()
+			_, err := parseConfig("")
 			if err == nil || err.Error() != fmt.Sprintf("required key %s missing value", rp) {
 				t.Fatal(fmt.Sprintf("Fail: omitting the required parameter %s did not lead to a parsing failure.", rp))
 			}
@@ -196,8 +202,122 @@ func TestRequiredParamsForIrsaAreChecked(t *testing.T) {
 	}
 }
 
+func TestVaultConfigOfTheReadme(t *testing.T) {
+	t.Setenv("ASP_CREDENTIALS_PROVIDER", "vault")
+	t.Setenv("ASP_VAULT_AUTH_TOKEN", "someTokenWhichAllowsYouToAccessVault")
+	t.Setenv("ASP_VAULT_URL", "https://vault.url.invalid")
+	t.Setenv("ASP_TARGET_URL", "https://someAWSServiceSupportingSignedHttpRequests")
+	t.Setenv("ASP_SERVICE", "s3")
+	t.Setenv("ASP_VAULT_CREDENTIALS_PATH", "/an-aws-engine-in-vault/creds/a-role-defined-aws")
+
+	e, err := parseConfig("")
+	handleError(err)
+	handleError(validateConfig(e))
+	if e.VaultCredentialsPath != "/an-aws-engine-in-vault/creds/a-role-defined-aws" {
+		t.Fatalf("expected the vault credentials path to be read, got %q", e.VaultCredentialsPath)
+	}
+}
+
+func TestVaultConfigFile(t *testing.T) {
+	for _, envVar := range []string{"ASP_TARGET_URL", "ASP_CREDENTIALS_PROVIDER", "ASP_VAULT_URL", "ASP_VAULT_CREDENTIALS_PATH", "ASP_VAULT_AUTH_TOKEN"} {
+		t.Setenv(envVar, "")
+		os.Unsetenv(envVar)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	handleError(os.WriteFile(path, []byte(`
+version: 1
+target_url: https://someAWSServiceSupportingSignedHttpRequests
+credentials_provider: vault
+vault:
+  url: https://vault.url.invalid
+  auth_token: someTokenWhichAllowsYouToAccessVault
+  credentials_path: /an-aws-engine-in-vault/creds/a-role-defined-aws
+`), 0600))
+
+	var out strings.Builder
+	if code := validate([]string{path}, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, out.String())
+	}
+}
+
 func handleError(err error) {
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"127.0.0.0/8", " 10.0.0.1", "::1"})
+	handleError(err)
+
+	expected := []string{"127.0.0.0/8", "10.0.0.1/32", "::1/128"}
+	if len(networks) != len(expected) {
+		t.Fatalf("expected %d networks, got %d", len(expected), len(networks))
+	}
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], network.String())
+		}
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	for _, envVar := range []string{"ASP_TARGET_URL", "ASP_CREDENTIALS_PROVIDER", "ASP_LOG_LEVEL", "ASP_RETRY_BUDGET_RATIO", "ASP_VAULT_URL", "ASP_VAULT_CREDENTIALS_PATH", "ASP_VAULT_AUTH_TOKEN", "ASP_FAILOVER_TARGET_URL", "ASP_TLS_SERVER_NAME"} {
+		t.Setenv(envVar, "")
+		os.Unsetenv(envVar)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	handleError(os.WriteFile(path, []byte(`
+version: 1
+target_url: https://search.eu-central-1.es.amazonaws.com
+failover:
+  targets:
+    - url: https://search.eu-west-1.es.amazonaws.com
+      region: eu-west-1
+    - url: not a url
+tls:
+  server_name: search.example.com
+credentials_provider: vault
+log:
+  level: verbose
+retry:
+  budget_ratio: 2
+  max_backof: 1s
+`), 0600))
+
+	var out strings.Builder
+	if code := validate([]string{path}, &out); code != 1 {
+		t.Fatalf("expected exit code 1, got %d: %s", code, out.String())
+	}
+	for _, problem := range []string{
+		"retry.max_backof: unknown setting",
+		"ASP_VAULT_URL: required for the vault credentials provider",
+		"ASP_LOG_LEVEL: \"verbose\" is not one of debug, info, warn or error",
+		"ASP_RETRY_BUDGET_RATIO: 2 is not between 0 and 1",
+		"ASP_TLS_SERVER_NAME: cannot be combined with failover targets",
+		"failover.targets[1].url: \"not a url\" is not an absolute URL",
+	} {
+		if !strings.Contains(out.String(), problem) {
+			t.Errorf("expected %q to be reported, got:\n%s", problem, out.String())
+		}
+	}
+
+	// the environment overrides the config file
+	t.Setenv("ASP_CREDENTIALS_PROVIDER", "awstoken")
+	t.Setenv("ASP_LOG_LEVEL", "debug")
+	t.Setenv("ASP_RETRY_BUDGET_RATIO", "0.5")
+	handleError(os.WriteFile(path, []byte(`
+version: 1
+target_url: https://search.eu-central-1.es.amazonaws.com
+credentials_provider: vault
+log:
+  level: verbose
+retry:
+  budget_ratio: 2
+`), 0600))
+
+	out.Reset()
+	if code := validate([]string{path}, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, out.String())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	configReloadsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "Number of configuration reloads by trigger and outcome",
+	}, []string{"trigger", "outcome"})
+	configLastReloadSuccessGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful configuration reload",
+	})
+)
+
+// swappableHandlers serves every request with the handlers of the current instance, which can be replaced atomically.
+// Requests already being served finish with the instance they started with, which is not closed before.
+type swappableHandlers struct {
+	current atomic.Value
+}
+
+func newSwappableHandlers(i *instance) *swappableHandlers {
+	h := &swappableHandlers{}
+	h.current.Store(i)
+	return h
+}
+
+func (h *swappableHandlers) instance() *instance {
+	return h.current.Load().(*instance)
+}
+
+// swap replaces the current instance and returns the previous one
+func (h *swappableHandlers) swap(i *instance) *instance {
+	return h.current.Swap(i).(*instance)
+}
+
+// acquire returns the current instance, which has to be released once the request has been served
+func (h *swappableHandlers) acquire() *instance {
+	for {
+		// a retired instance has been replaced already, so the next one is current
+		if i := h.instance(); i.acquire() {
+			return i
+		}
+	}
+}
+
+func (h *swappableHandlers) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	i := h.acquire()
+	defer i.release()
+	i.handler.ServeHTTP(w, req)
+}
+
+// mgmtHandlers returns handlers delegating to the management endpoints of the current instance,
+// since handlers cannot be removed from the management mux once it serves
+func (h *swappableHandlers) mgmtHandlers() map[string]http.Handler {
+	handlers := map[string]http.Handler{}
+	for _, pattern := range []string{"/status/ready", "/status/identity", "/admin/"} {
+		pattern := pattern
+		handlers[pattern] = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			i := h.acquire()
+			defer i.release()
+			handler, ok := i.mgmtHandlers[pattern]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			handler.ServeHTTP(w, req)
+		})
+	}
+	return handlers
+}
+
+// reloader rebuilds the instance from the config file and the environment on SIGHUP or when the config file changes.
+// If the new configuration is invalid, the proxy keeps running with the current one.
+type reloader struct {
+	mutex    sync.Mutex
+	path     string
+	checksum [sha256.Size]byte
+	config   EnvConfig
+	handlers *swappableHandlers
+	signals  chan os.Signal
+	done     chan struct{}
+	retiring sync.WaitGroup
+}
+
+// newReloader watches the config file at path, an empty path only reloads the environment on SIGHUP
+func newReloader(path string, e EnvConfig, handlers *swappableHandlers) *reloader {
+	r := &reloader{path: path, config: e, handlers: handlers, signals: make(chan os.Signal, 1), done: make(chan struct{})}
+	if path != "" {
+		r.checksum, _ = checksum(path)
+	}
+	return r
+}
+
+// watch reloads on SIGHUP and checks the config file for changes every interval, 0 disables checking the file
+func (r *reloader) watch(interval time.Duration) {
+	signal.Notify(r.signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-r.signals:
+				_ = r.reload("signal")
+			case <-r.done:
+				return
+			}
+		}
+	}()
+
+	if r.path == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if r.fileChanged() {
+					_ = r.reload("file")
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop ends watching and waits for a running reload, so the instance is not replaced anymore
+func (r *reloader) stop() {
+	signal.Stop(r.signals)
+	close(r.done)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+}
+
+func (r *reloader) fileChanged() bool {
+	current, err := checksum(r.path)
+	if err != nil {
+		// e.g. while the file is being replaced, the next check picks it up
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return current != r.checksum
+}
+
+func (r *reloader) reload(trigger string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+		// shutting down
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	if r.path != "" {
+		// a broken file is reported once and not again until it changes
+		r.checksum, _ = checksum(r.path)
+	}
+
+	e, err := r.load()
+	var next *instance
+	if err == nil {
+		next, err = newInstance(e)
+	}
+	if err != nil {
+		configReloadsCounter.WithLabelValues(trigger, "failure").Inc()
+		Logger.Error("Reloading the configuration failed. Keeping the current configuration.", zap.String("trigger", trigger), zap.Error(err))
+		return err
+	}
+
+	for _, setting := range restartRequired(r.config, e) {
+		Logger.Warn("Changing this setting requires a restart. Keeping the current value.", zap.String("setting", setting))
+	}
+	if e.LogLevel != r.config.LogLevel {
+		level, _ := zapcore.ParseLevel(e.LogLevel)
+		Level.SetLevel(level)
+	}
+	registerSecrets(e)
+
+	r.config = e
+	r.retire(r.handlers.swap(next))
+
+	configReloadsCounter.WithLabelValues(trigger, "success").Inc()
+	configLastReloadSuccessGauge.SetToCurrentTime()
+	Logger.Info("Reloaded the configuration", zap.String("trigger", trigger), zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// retire shuts the replaced instance down in the background once its requests in flight finished,
+// so they keep their credentials, and revokes its Vault leases
+func (r *reloader) retire(previous *instance) {
+	r.retiring.Add(1)
+	go func() {
+		defer r.retiring.Done()
+		previous.drain(previous.config.ShutdownTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), previous.config.ShutdownTimeout)
+		defer cancel()
+		previous.shutdown(ctx)
+	}()
+}
+
+// awaitRetired waits until all replaced instances have been shut down
+func (r *reloader) awaitRetired() {
+	r.retiring.Wait()
+}
+
+// load reads the config file again with the environment on top
+func (r *reloader) load() (EnvConfig, error) {
+	e, err := readConfig(r.path)
+	if err != nil {
+		return e, err
+	}
+	return e, validateConfig(e)
+}
+
+// restartRequired lists the changed settings which only take effect after a restart
+func restartRequired(current EnvConfig, next EnvConfig) []string {
+	var settings []string
+	if current.Port != next.Port {
+		settings = append(settings, "ASP_PORT")
+	}
+	if current.MgmtPort != next.MgmtPort {
+		settings = append(settings, "ASP_MGMT_PORT")
+	}
+	if current.MetricsPath != next.MetricsPath {
+		settings = append(settings, "ASP_METRICS_PATH")
+	}
+	if current.LogEncoding != next.LogEncoding || current.LogSamplingInitial != next.LogSamplingInitial || current.LogSamplingThereafter != next.LogSamplingThereafter {
+		settings = append(settings, "ASP_LOG_ENCODING/ASP_LOG_SAMPLING")
+	}
+	if current.ServerReadHeaderTimeout != next.ServerReadHeaderTimeout || current.ServerReadTimeout != next.ServerReadTimeout ||
+		current.ServerWriteTimeout != next.ServerWriteTimeout || current.ServerIdleTimeout != next.ServerIdleTimeout ||
+		current.ServerMaxHeaderBytes != next.ServerMaxHeaderBytes {
+		settings = append(settings, "ASP_SERVER_*")
+	}
+	if current.ConfigWatchInterval != next.ConfigWatchInterval {
+		settings = append(settings, "ASP_CONFIG_WATCH_INTERVAL")
+	}
+	return settings
+}
+
+func checksum(path string) ([sha256.Size]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(content), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadSwapsTheTarget(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer second.Close()
+
+	for _, envVar := range []string{"ASP_TARGET_URL", "ASP_CONFIG_FILE", "ASP_LOG_LEVEL"} {
+		t.Setenv(envVar, "")
+		os.Unsetenv(envVar)
+	}
+	t.Setenv("ASP_SERVICE", "s3")
+	t.Setenv("ASP_CREDENTIALS_PROVIDER", "awstoken")
+	t.Setenv("AWS_ACCESS_KEY_ID", "FOO")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "BAR")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	handleError(os.WriteFile(path, []byte("version: 1\ntarget_url: "+first.URL+"\n"), 0600))
+
+	e, err := readConfig(path)
+	handleError(err)
+	current, err := newInstance(e)
+	handleError(err)
+	handlers := newSwappableHandlers(current)
+	r := newReloader(path, e, handlers)
+
+	assertStatus(t, handlers, http.StatusOK)
+
+	// a valid file replaces the target
+	handleError(os.WriteFile(path, []byte("version: 1\ntarget_url: "+second.URL+"\n"), 0600))
+	if !r.fileChanged() {
+		t.Fatal("expected the change of the config file to be noticed")
+	}
+	if err := r.reload("file"); err != nil {
+		t.Fatalf("expected the reload to succeed, got %v", err)
+	}
+	if r.fileChanged() {
+		t.Fatal("expected the reloaded config file to be unchanged")
+	}
+	assertStatus(t, handlers, http.StatusAccepted)
+
+	// an invalid file keeps the current configuration
+	failures := testutil.ToFloat64(configReloadsCounter.WithLabelValues("signal", "failure"))
+	handleError(os.WriteFile(path, []byte("version: 1\ntarget_url: not a url\n"), 0600))
+	if err := r.reload("signal"); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	assertStatus(t, handlers, http.StatusAccepted)
+	if target, ok := os.LookupEnv("ASP_TARGET_URL"); ok {
+		t.Errorf("expected the environment to be left unchanged, got ASP_TARGET_URL %q", target)
+	}
+	if testutil.ToFloat64(configReloadsCounter.WithLabelValues("signal", "failure")) != failures+1 {
+		t.Error("expected the failed reload to be counted")
+	}
+}
+
+func assertStatus(t *testing.T, handler http.Handler, expected int) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != expected {
+		t.Fatalf("expected HTTP status %d, got %d", expected, recorder.Code)
+	}
+}
+
+func TestReplacedInstanceIsShutDownOnceDrained(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	var closed, revoked atomic.Bool
+	previous := &instance{
+		config: EnvConfig{ShutdownTimeout: 5 * time.Second},
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-finish
+			w.WriteHeader(http.StatusOK)
+		}),
+		closers: []func(){func() { closed.Store(true) }},
+		shutdownHooks: []func(ctx context.Context) error{func(ctx context.Context) error {
+			revoked.Store(true)
+			return nil
+		}},
+	}
+	next := &instance{handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})}
+	handlers := newSwappableHandlers(previous)
+	r := newReloader("", EnvConfig{}, handlers)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assertStatus(t, handlers, http.StatusOK)
+	}()
+	<-started
+
+	r.retire(handlers.swap(next))
+	assertStatus(t, handlers, http.StatusAccepted)
+	time.Sleep(50 * time.Millisecond)
+	if closed.Load() || revoked.Load() {
+		t.Fatal("expected the replaced instance to stay open while a request is in flight")
+	}
+
+	close(finish)
+	<-done
+	r.awaitRetired()
+	if !closed.Load() || !revoked.Load() {
+		t.Errorf("expected the replaced instance to be closed and its leases revoked, got closed %v, revoked %v", closed.Load(), revoked.Load())
+	}
+}
+
+func TestFailedInstanceStopsItsRefresher(t *testing.T) {
+	vaultServer := httptest.NewServer(http.NotFoundHandler())
+	vaultServer.Close()
+	for _, envVar := range []string{"ASP_CONFIG_FILE", "ASP_SIGNATURE_DEBUG_TRUSTED_NETWORKS"} {
+		t.Setenv(envVar, "")
+		os.Unsetenv(envVar)
+	}
+	t.Setenv("ASP_TARGET_URL", "https://someAWSServiceSupportingSignedHttpRequests")
+	t.Setenv("ASP_CREDENTIALS_PROVIDER", "vault")
+	t.Setenv("ASP_VAULT_URL", vaultServer.URL)
+	t.Setenv("ASP_VAULT_CREDENTIALS_PATH", "/aws/creds/search")
+	t.Setenv("ASP_VAULT_AUTH_TOKEN", "secret")
+	t.Setenv("ASP_ASYNC_CREDENTIALS_FETCH", "true")
+
+	e, err := readConfig("")
+	handleError(err)
+	e.SignatureDebugTrustedNetworks = []string{"not a network"}
+
+	refreshers := runningRefreshers()
+	if _, err := newInstance(e); err == nil {
+		t.Fatal("expected the instance to fail")
+	}
+	// give a leaked refresher the time to show up
+	time.Sleep(100 * time.Millisecond)
+	if running := runningRefreshers(); running != refreshers {
+		t.Errorf("expected the refresher of the failed instance to be stopped, got %d running instead of %d", running, refreshers)
+	}
+}
+
+func runningRefreshers() int {
+	var out strings.Builder
+	handleError(pprof.Lookup("goroutine").WriteTo(&out, 2))
+	return strings.Count(out.String(), "refresher.(*Refresher).run(")
+}
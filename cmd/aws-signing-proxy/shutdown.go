@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the server until it is shut down
+func serve(server *http.Server) {
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		Logger.Fatal("Something went wrong", zap.String("address", server.Addr), zap.Error(err))
+	}
+}
+
+// awaitShutdown blocks until SIGTERM or SIGINT and shuts the proxy down gracefully.
+// A second signal terminates the proxy at once.
+func awaitShutdown(server *http.Server, mgmtServer *http.Server, reloader *reloader, handlers *swappableHandlers) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	received := <-signals
+	signal.Stop(signals)
+
+	Logger.Info("Shutting down", zap.String("signal", received.String()))
+	shutdown(server, mgmtServer, reloader, handlers)
+}
+
+// shutdown fails the readiness endpoint first and waits for the pre-stop delay, so load balancers stop sending new requests.
+// Then the requests in flight are drained until the shutdown timeout, while the management port keeps serving.
+func shutdown(server *http.Server, mgmtServer *http.Server, reloader *reloader, handlers *swappableHandlers) {
+	reloader.stop()
+	current := handlers.instance()
+	current.readiness.Drain()
+
+	time.Sleep(current.config.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), current.config.ShutdownTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		Logger.Warn("Requests in flight did not finish in time", zap.Duration("timeout", current.config.ShutdownTimeout), zap.Error(err))
+	} else {
+		Logger.Info("Drained all requests in flight", zap.Duration("duration", time.Since(start)))
+	}
+	if err := mgmtServer.Shutdown(ctx); err != nil {
+		_ = mgmtServer.Close()
+	}
+
+	reloader.awaitRetired()
+	current.shutdown(ctx)
+	Logger.Info("Shut down")
+}
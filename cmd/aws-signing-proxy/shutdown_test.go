@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/kelseyhightower/envconfig"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsRequestsInFlight(t *testing.T) {
+	received := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(received)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	t.Setenv("ASP_CONFIG_FILE", "")
+	os.Unsetenv("ASP_CONFIG_FILE")
+	t.Setenv("ASP_TARGET_URL", target.URL)
+	t.Setenv("ASP_CREDENTIALS_PROVIDER", "awstoken")
+	t.Setenv("ASP_SHUTDOWN_DELAY", "0s")
+	t.Setenv("AWS_ACCESS_KEY_ID", "FOO")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "BAR")
+
+	var e EnvConfig
+	handleError(envconfig.Process("ASP", &e))
+	current, err := newInstance(e)
+	handleError(err)
+	handlers := newSwappableHandlers(current)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(err)
+	server := &http.Server{Handler: handlers}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	status := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		handleError(err)
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-received
+
+	shutdown(server, &http.Server{}, newReloader("", e, handlers), handlers)
+
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("expected the request in flight to finish with status 200, got %d", code)
+	}
+	assertStatus(t, handlers.mgmtHandlers()["/status/ready"], http.StatusServiceUnavailable)
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Error("expected the proxy to refuse new connections")
+	}
+}
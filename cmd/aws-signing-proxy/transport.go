@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTransportConfig reads the CA bundle and the settings of the egress proxy the upstream is reached through
+func newTransportConfig(e EnvConfig) (proxy.TransportConfig, error) {
+	config := proxy.TransportConfig{
+		MaxIdleConns:          e.MaxIdleConns,
+		MaxIdleConnsPerHost:   e.MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: e.ResponseHeaderTimeout,
+		ExpectContinueTimeout: e.ExpectContinueTimeout,
+		TLSHandshakeTimeout:   e.TlsHandshakeTimeout,
+		ServerName:            e.TlsServerName,
+	}
+
+	minVersion, ok := tlsVersions[e.TlsMinVersion]
+	if !ok {
+		return config, fmt.Errorf("ASP_TLS_MIN_VERSION: %q is not one of 1.0, 1.1, 1.2 or 1.3", e.TlsMinVersion)
+	}
+	config.MinTLSVersion = minVersion
+
+	if e.TlsCaFile != "" {
+		bundle, err := os.ReadFile(e.TlsCaFile)
+		if err != nil {
+			return config, fmt.Errorf("ASP_TLS_CA_FILE: %w", err)
+		}
+		// the CAs are added to the system roots, so AWS can still be reached directly as well
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return config, fmt.Errorf("ASP_TLS_CA_FILE: no PEM encoded certificates found in %s", e.TlsCaFile)
+		}
+		config.RootCAs = roots
+	}
+
+	if e.UpstreamProxyUrl != "" {
+		proxyURL, err := url.Parse(e.UpstreamProxyUrl)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			// the value is not repeated, as it may contain a password
+			return config, errors.New("ASP_UPSTREAM_PROXY_URL: not an absolute URL")
+		}
+		if e.UpstreamProxyUsername != "" {
+			proxyURL.User = url.UserPassword(e.UpstreamProxyUsername, e.UpstreamProxyPassword)
+		}
+		config.Proxy = proxyURL
+	}
+	return config, nil
+}
+
+// newHttpClient connects to Vault, the OIDC auth server and STS with the transport settings of the upstream.
+// The server name is left out, as it only matches the target.
+func newHttpClient(e EnvConfig, config proxy.TransportConfig) *http.Client {
+	config.ServerName = ""
+	return &http.Client{
+		Transport: proxy.NewTransport(proxy.Config{
+			DialTimeout:     e.DialTimeout,
+			IdleConnTimeout: e.IdleConnTimeout,
+			Transport:       config,
+		}),
+	}
+}
+
+// newStsConfig selects the STS endpoint, e.g. a VPC endpoint in a private subnet, a FIPS endpoint or a local stub
+func newStsConfig(e EnvConfig, httpClient *http.Client) (*aws.Config, error) {
+	config := aws.NewConfig().WithHTTPClient(httpClient)
+
+	if e.StsEndpoint != "" {
+		endpoint, err := url.Parse(e.StsEndpoint)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("ASP_STS_ENDPOINT: %q is not an absolute URL", e.StsEndpoint)
+		}
+		config = config.WithEndpoint(e.StsEndpoint)
+	}
+
+	switch e.StsRegionalEndpoint {
+	case "":
+		// the default of the SDK, which can be changed with AWS_STS_REGIONAL_ENDPOINTS
+	case "regional":
+		config = config.WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint)
+	case "global":
+		config = config.WithSTSRegionalEndpoint(endpoints.LegacySTSEndpoint)
+	default:
+		return nil, fmt.Errorf("ASP_STS_REGIONAL_ENDPOINT: %q is neither regional nor global", e.StsRegionalEndpoint)
+	}
+
+	if e.StsUseFipsEndpoint {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if e.StsUseDualStackEndpoint {
+		config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	return config, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/pem"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/idealo/aws-signing-proxy/pkg/irsa"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransportTrustsCaFile(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	handleError(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+
+	e := EnvConfig{TlsMinVersion: "1.2"}
+	config, err := newTransportConfig(e)
+	handleError(err)
+	if _, err := newHttpClient(e, config).Get(upstream.URL); err == nil {
+		t.Fatal("expected the certificate of the upstream not to be trusted without the CA file")
+	}
+
+	e.TlsCaFile = caFile
+	config, err = newTransportConfig(e)
+	handleError(err)
+	resp, err := newHttpClient(e, config).Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("expected the certificate of the upstream to be trusted, got %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestTransportUsesUpstreamProxy(t *testing.T) {
+	var proxyAuthorization, requestURI string
+	egress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxyAuthorization = req.Header.Get("Proxy-Authorization")
+		requestURI = req.RequestURI
+	}))
+	defer egress.Close()
+
+	e := EnvConfig{
+		TlsMinVersion:         "1.2",
+		UpstreamProxyUrl:      egress.URL,
+		UpstreamProxyUsername: "user",
+		UpstreamProxyPassword: "secret",
+	}
+	config, err := newTransportConfig(e)
+	handleError(err)
+	resp, err := newHttpClient(e, config).Get("http://search.eu-central-1.es.amazonaws.com/_cluster/health")
+	handleError(err)
+	_ = resp.Body.Close()
+
+	if requestURI != "http://search.eu-central-1.es.amazonaws.com/_cluster/health" {
+		t.Errorf("expected the request to go through the proxy, got %q", requestURI)
+	}
+	// base64 of user:secret
+	if proxyAuthorization != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("expected the proxy credentials to be sent, got %q", proxyAuthorization)
+	}
+}
+
+func TestTransportConfigRejectsInvalidSettings(t *testing.T) {
+	for _, testCase := range []struct {
+		config   EnvConfig
+		expected string
+	}{
+		{EnvConfig{TlsMinVersion: "1.4"}, "ASP_TLS_MIN_VERSION"},
+		{EnvConfig{TlsMinVersion: "1.2", TlsCaFile: "/nonexistent/ca.pem"}, "ASP_TLS_CA_FILE"},
+		{EnvConfig{TlsMinVersion: "1.2", UpstreamProxyUrl: "user:secret@egress:3128"}, "ASP_UPSTREAM_PROXY_URL"},
+	} {
+		_, err := newTransportConfig(testCase.config)
+		if err == nil || !strings.HasPrefix(err.Error(), testCase.expected) {
+			t.Errorf("expected an error for %s, got %v", testCase.expected, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "secret") {
+			t.Errorf("expected the proxy password not to be part of the error, got %v", err)
+		}
+	}
+}
+
+func TestStsConfigSelectsEndpoint(t *testing.T) {
+	for _, testCase := range []struct {
+		config   EnvConfig
+		region   string
+		expected string
+	}{
+		{EnvConfig{StsRegionalEndpoint: "regional"}, "eu-central-1", "https://sts.eu-central-1.amazonaws.com"},
+		{EnvConfig{StsRegionalEndpoint: "global"}, "eu-central-1", "https://sts.amazonaws.com"},
+		{EnvConfig{StsUseFipsEndpoint: true}, "us-east-1", "https://sts-fips.us-east-1.amazonaws.com"},
+		{EnvConfig{StsEndpoint: "https://vpce-0123.sts.eu-central-1.vpce.amazonaws.com"}, "eu-central-1", "https://vpce-0123.sts.eu-central-1.vpce.amazonaws.com"},
+	} {
+		config, err := newStsConfig(testCase.config, nil)
+		handleError(err)
+		if endpoint := irsa.InitClient(testCase.region, config).(*sts.STS).Endpoint; endpoint != testCase.expected {
+			t.Errorf("expected %s, got %s", testCase.expected, endpoint)
+		}
+	}
+
+	if _, err := newStsConfig(EnvConfig{StsRegionalEndpoint: "local"}, nil); err == nil {
+		t.Error("expected an unknown endpoint selection to be rejected")
+	}
+}
+
+func TestIrsaUsesStsStub(t *testing.T) {
+	var action string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		action = req.Form.Get("Action")
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIASTUB</AccessKeyId>
+      <SecretAccessKey>secretKey</SecretAccessKey>
+      <SessionToken>sessionToken</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer stub.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	handleError(os.WriteFile(tokenFile, []byte("webIdentityToken"), 0600))
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+
+	e := EnvConfig{TlsMinVersion: "1.2", StsEndpoint: stub.URL}
+	transportConfig, err := newTransportConfig(e)
+	handleError(err)
+	stsConfig, err := newStsConfig(e, newHttpClient(e, transportConfig))
+	handleError(err)
+
+	credentials := &proxy.RefreshedCredentials{}
+	handleError(irsa.NewIRSAClient("eu-central-1", "aws-signing-proxy", "arn:aws:iam::123456242:role/some-access-role", stsConfig).RefreshCredentials(credentials))
+
+	if action != "AssumeRoleWithWebIdentity" || credentials.Data.AccessKey != "ASIASTUB" {
+		t.Errorf("expected the credentials of the stub, got %q from action %q", credentials.Data.AccessKey, action)
+	}
+}
@@ -1,6 +1,8 @@
 package circuitbreaker
 
 import (
+	"context"
+	"errors"
 	. "github.com/idealo/aws-signing-proxy/pkg/logging"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -8,27 +10,103 @@ import (
 	"go.uber.org/zap"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
+const maxHistory = 20
+
 type CircuitBreaker struct {
-	breaker *gobreaker.CircuitBreaker
+	mutex    sync.RWMutex
+	breaker  *gobreaker.TwoStepCircuitBreaker
+	settings gobreaker.Settings
+	metrics  breakerMetrics
+
+	historyMutex sync.Mutex
+	history      []StateChange
 }
 
-func NewCircuitBreaker() *CircuitBreaker {
+// StateChange is a single transition of the circuit breaker state
+type StateChange struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// Settings configures when a circuit breaker trips and how it recovers
+type Settings struct {
+	// Timeout is how long the circuit stays open before it becomes half-open
+	Timeout time.Duration
+	// MaxHalfOpenRequests is the number of probe requests let through while half-open.
+	// The circuit closes once all of them succeeded.
+	MaxHalfOpenRequests uint32
+	// Interval is the cyclic period of the closed state after which the counts are cleared, 0 never clears them
+	Interval time.Duration
+	// FailureThreshold trips the circuit once more consecutive requests failed
+	FailureThreshold uint32
+	// FailureRatio additionally trips the circuit once the ratio of failed requests reaches it, 0 disables it
+	FailureRatio float64
+	// MinRequests is the number of requests needed within an interval before the failure ratio is considered
+	MinRequests uint32
+}
 
-	timeout := getTimeout()
-	failureThreshold := getFailureThreshold()
+// DefaultSettings returns the settings configured by ASP_CIRCUIT_BREAKER_TIMEOUT and ASP_CIRCUIT_BREAKER_FAILURE_THRESHOLD
+func DefaultSettings() Settings {
+	return Settings{
+		Timeout:             getTimeout(),
+		MaxHalfOpenRequests: 1,
+		FailureThreshold:    getFailureThreshold(),
+		MinRequests:         10,
+	}
+}
+
+// NewCircuitBreaker creates a circuit breaker with the default settings whose metrics and log messages are labelled with the given name
+func NewCircuitBreaker(name string) *CircuitBreaker {
+	return NewCircuitBreakerWithSettings(name, DefaultSettings())
+}
 
-	st := gobreaker.Settings{
-		Name:    "auth-circuit-breaker",
-		Timeout: timeout,
+// NewCircuitBreakerWithSettings creates a circuit breaker with the given settings.
+// Errors caused by client errors (see StatusError) do not count as failures.
+func NewCircuitBreakerWithSettings(name string, settings Settings) *CircuitBreaker {
+	return newCircuitBreaker(name, settings, authMetrics)
+}
+
+// NewUpstreamCircuitBreaker creates a circuit breaker guarding the target, which is exported with the upstream_circuit_breaker_* metrics
+func NewUpstreamCircuitBreaker(name string, settings Settings) *CircuitBreaker {
+	return newCircuitBreaker(name, settings, upstreamMetrics)
+}
+
+func newCircuitBreaker(name string, settings Settings, metrics breakerMetrics) *CircuitBreaker {
+
+	cb := &CircuitBreaker{metrics: metrics}
+	cb.settings = gobreaker.Settings{
+		Name:        name,
+		MaxRequests: settings.MaxHalfOpenRequests,
+		Interval:    settings.Interval,
+		Timeout:     settings.Timeout,
 		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures > failureThreshold
+			return readyToTrip(settings, counts)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			cb.onStateChange(from, to)
+		},
+		IsSuccessful: func(err error) bool {
+			return err == nil || IsClientError(err) || errors.Is(err, context.Canceled)
 		},
 	}
-	return &CircuitBreaker{breaker: gobreaker.NewCircuitBreaker(st)}
+	cb.breaker = gobreaker.NewTwoStepCircuitBreaker(cb.settings)
+	cb.metrics.setState(name, gobreaker.StateClosed)
+	return cb
+}
+
+func readyToTrip(settings Settings, counts gobreaker.Counts) bool {
+	if counts.ConsecutiveFailures > settings.FailureThreshold {
+		return true
+	}
+	if settings.FailureRatio <= 0 || counts.Requests < settings.MinRequests {
+		return false
+	}
+	return float64(counts.TotalFailures)/float64(counts.Requests) >= settings.FailureRatio
 }
 
 func getFailureThreshold() uint32 {
@@ -65,48 +143,157 @@ func getTimeout() time.Duration {
 }
 
 var (
-	cbStateGauge   = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "auth_circuit_breaker_state", Help: "State of the authorization circuit breaker"}, []string{"state"})
-	cbCounterGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "auth_circuit_breaker_count", Help: "Circuit breaker request count"}, []string{"type"})
+	cbStateGauge       = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "auth_circuit_breaker_state", Help: "State of the circuit breaker"}, []string{"name", "state"})
+	cbCounterGauge     = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "auth_circuit_breaker_count", Help: "Circuit breaker request count"}, []string{"name", "type"})
+	cbStateChangeCount = promauto.NewCounterVec(prometheus.CounterOpts{Name: "auth_circuit_breaker_state_changes_total", Help: "Number of state changes of the circuit breaker"}, []string{"name", "from", "to"})
+
+	upstreamStateGauge       = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "upstream_circuit_breaker_state", Help: "State of the circuit breaker guarding the target"}, []string{"name", "state"})
+	upstreamCounterGauge     = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "upstream_circuit_breaker_count", Help: "Request count of the circuit breaker guarding the target"}, []string{"name", "type"})
+	upstreamStateChangeCount = promauto.NewCounterVec(prometheus.CounterOpts{Name: "upstream_circuit_breaker_state_changes_total", Help: "Number of state changes of the circuit breaker guarding the target"}, []string{"name", "from", "to"})
+
+	authMetrics     = breakerMetrics{state: cbStateGauge, count: cbCounterGauge, stateChanges: cbStateChangeCount}
+	upstreamMetrics = breakerMetrics{state: upstreamStateGauge, count: upstreamCounterGauge, stateChanges: upstreamStateChangeCount}
 )
 
-func (cb *CircuitBreaker) Execute(req func() (interface{}, error)) (interface{}, error) {
+// breakerMetrics are the metrics a circuit breaker is exported with, the breakers of the credentials providers and the one
+// of the target are kept apart so they can be alerted on separately
+type breakerMetrics struct {
+	state        *prometheus.GaugeVec
+	count        *prometheus.GaugeVec
+	stateChanges *prometheus.CounterVec
+}
 
-	response, err := cb.breaker.Execute(req)
-
-	switch cb.breaker.State() {
-	case gobreaker.StateOpen:
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateOpen.String()}).Set(1)
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateClosed.String()}).Set(0)
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateHalfOpen.String()}).Set(0)
-	case gobreaker.StateHalfOpen:
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateOpen.String()}).Set(0)
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateHalfOpen.String()}).Set(1)
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateClosed.String()}).Set(0)
-	case gobreaker.StateClosed:
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateOpen.String()}).Set(0)
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateHalfOpen.String()}).Set(0)
-		cbStateGauge.With(prometheus.Labels{"state": gobreaker.StateClosed.String()}).Set(1)
+func (m breakerMetrics) setState(name string, state gobreaker.State) {
+	for _, s := range []gobreaker.State{gobreaker.StateClosed, gobreaker.StateHalfOpen, gobreaker.StateOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.state.WithLabelValues(name, s.String()).Set(value)
 	}
+}
+
+func (m breakerMetrics) setCounts(name string, counts gobreaker.Counts) {
+	m.count.WithLabelValues(name, "requests").Set(float64(counts.Requests))
+	m.count.WithLabelValues(name, "total_successes").Set(float64(counts.TotalSuccesses))
+	m.count.WithLabelValues(name, "total_failures").Set(float64(counts.TotalFailures))
+	m.count.WithLabelValues(name, "consecutive_successes").Set(float64(counts.ConsecutiveSuccesses))
+	m.count.WithLabelValues(name, "consecutive_failures").Set(float64(counts.ConsecutiveFailures))
+}
+
+func (cb *CircuitBreaker) Name() string {
+	return cb.current().Name()
+}
+
+func (cb *CircuitBreaker) State() gobreaker.State {
+	return cb.current().State()
+}
 
-	cbCounterGauge.WithLabelValues("requests").Set(float64(cb.breaker.Counts().Requests))
-	cbCounterGauge.WithLabelValues("total_successes").Set(float64(cb.breaker.Counts().TotalSuccesses))
-	cbCounterGauge.WithLabelValues("total_failures").Set(float64(cb.breaker.Counts().TotalFailures))
-	cbCounterGauge.WithLabelValues("consecutive_successes").Set(float64(cb.breaker.Counts().ConsecutiveSuccesses))
-	cbCounterGauge.WithLabelValues("consecutive_failures").Set(float64(cb.breaker.Counts().ConsecutiveFailures))
+func (cb *CircuitBreaker) Counts() gobreaker.Counts {
+	return cb.current().Counts()
+}
 
+// History returns the most recent state changes, oldest first
+func (cb *CircuitBreaker) History() []StateChange {
+	cb.historyMutex.Lock()
+	defer cb.historyMutex.Unlock()
+	return append([]StateChange{}, cb.history...)
+}
+
+// Reset moves the circuit breaker back to the closed state and clears its counts
+func (cb *CircuitBreaker) Reset() {
+	cb.mutex.Lock()
+	from := cb.breaker.State()
+	cb.breaker = gobreaker.NewTwoStepCircuitBreaker(cb.settings)
+	cb.mutex.Unlock()
+
+	if from != gobreaker.StateClosed {
+		cb.onStateChange(from, gobreaker.StateClosed)
+	}
+	cb.metrics.setCounts(cb.settings.Name, gobreaker.Counts{})
+	Logger.Info("Circuit breaker has been reset.", zap.String("name", cb.settings.Name), zap.String("previous-state", from.String()))
+}
+
+func (cb *CircuitBreaker) current() *gobreaker.TwoStepCircuitBreaker {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return cb.breaker
+}
+
+// onStateChange is called by gobreaker whenever the state changes, so it must not call back into the breaker
+func (cb *CircuitBreaker) onStateChange(from gobreaker.State, to gobreaker.State) {
+	name := cb.settings.Name
+	cb.metrics.setState(name, to)
+	cb.metrics.stateChanges.WithLabelValues(name, from.String(), to.String()).Inc()
+
+	if to == gobreaker.StateOpen {
+		Logger.Warn("Circuit breaker opened.", zap.String("name", name), zap.String("from", from.String()))
+	} else {
+		Logger.Info("Circuit breaker changed state.", zap.String("name", name), zap.String("from", from.String()), zap.String("to", to.String()))
+	}
+
+	cb.historyMutex.Lock()
+	defer cb.historyMutex.Unlock()
+
+	cb.history = append(cb.history, StateChange{From: from.String(), To: to.String(), At: time.Now()})
+	if len(cb.history) > maxHistory {
+		cb.history = cb.history[len(cb.history)-maxHistory:]
+	}
+}
+
+// Allow checks whether a request may pass without logging. The returned callback has to be called with the outcome of the request.
+// It is meant for callers which judge success themselves, e.g. by the status code of a response.
+func (cb *CircuitBreaker) Allow() (done func(success bool), err error) {
+
+	breaker := cb.current()
+	report, err := breaker.Allow()
 	if err != nil {
-		if strings.Contains(err.Error(), "circuit breaker is open") {
+		return nil, err
+	}
+
+	return func(success bool) {
+		report(success)
+		cb.metrics.setCounts(breaker.Name(), breaker.Counts())
+	}, nil
+}
+
+func (cb *CircuitBreaker) Execute(req func() (interface{}, error)) (interface{}, error) {
+
+	breaker := cb.current()
+	response, err := cb.execute(breaker, req)
+	cb.metrics.setCounts(breaker.Name(), breaker.Counts())
+
+	if err != nil {
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
 			Logger.Warn(
 				"Request to authorization server failed. Circuit breaker is open.",
-				zap.String("name", cb.breaker.Name()),
-				zap.String("state", cb.breaker.State().String()),
+				zap.String("name", breaker.Name()),
+				zap.String("state", breaker.State().String()),
 			)
 			return response, err
 		} else {
-			Logger.Error("An error appeared", zap.Error(err))
+			Logger.Error("An error appeared", zap.String("name", breaker.Name()), zap.Error(err))
 			return response, err
 		}
 	}
 
 	return response, err
 }
+
+func (cb *CircuitBreaker) execute(breaker *gobreaker.TwoStepCircuitBreaker, req func() (interface{}, error)) (interface{}, error) {
+	done, err := breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			done(false)
+			panic(e)
+		}
+	}()
+
+	response, err := req()
+	done(cb.settings.IsSuccessful(err))
+	return response, err
+}
@@ -13,7 +13,8 @@ import (
 
 func TestCircuitBreakerOpenState(t *testing.T) {
 
-	breaker := NewCircuitBreaker()
+	resetMetrics()
+	breaker := NewCircuitBreaker("open")
 
 	for i := 0; i < 10; i++ {
 		breaker.Execute(func() (interface{}, error) {
@@ -24,11 +25,11 @@ func TestCircuitBreakerOpenState(t *testing.T) {
 	assert.Equal(t, gobreaker.StateOpen, breaker.breaker.State())
 
 	expectedStateMetric := `
-# HELP auth_circuit_breaker_state State of the authorization circuit breaker
+# HELP auth_circuit_breaker_state State of the circuit breaker
 # TYPE auth_circuit_breaker_state gauge
-auth_circuit_breaker_state{state="closed"} 0
-auth_circuit_breaker_state{state="half-open"} 0
-auth_circuit_breaker_state{state="open"} 1
+auth_circuit_breaker_state{name="open",state="closed"} 0
+auth_circuit_breaker_state{name="open",state="half-open"} 0
+auth_circuit_breaker_state{name="open",state="open"} 1
 `
 
 	if err := testutil.CollectAndCompare(cbStateGauge, strings.NewReader(expectedStateMetric), "auth_circuit_breaker_state"); err != nil {
@@ -38,21 +39,24 @@ auth_circuit_breaker_state{state="open"} 1
 	expectedCountMetric := `
 # HELP auth_circuit_breaker_count Circuit breaker request count
 # TYPE auth_circuit_breaker_count gauge
-auth_circuit_breaker_count{type="consecutive_failures"} 0
-auth_circuit_breaker_count{type="consecutive_successes"} 0
-auth_circuit_breaker_count{type="requests"} 0
-auth_circuit_breaker_count{type="total_failures"} 0
-auth_circuit_breaker_count{type="total_successes"} 0
+auth_circuit_breaker_count{name="open",type="consecutive_failures"} 0
+auth_circuit_breaker_count{name="open",type="consecutive_successes"} 0
+auth_circuit_breaker_count{name="open",type="requests"} 0
+auth_circuit_breaker_count{name="open",type="total_failures"} 0
+auth_circuit_breaker_count{name="open",type="total_successes"} 0
 `
 
 	if err := testutil.CollectAndCompare(cbCounterGauge, strings.NewReader(expectedCountMetric), "auth_circuit_breaker_count"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cbStateChangeCount.WithLabelValues("open", "closed", "open")))
 }
 
 func TestCircuitBreakerClosedState(t *testing.T) {
 
-	breaker := NewCircuitBreaker()
+	resetMetrics()
+	breaker := NewCircuitBreaker("closed")
 
 	for i := 0; i < 10; i++ {
 		breaker.Execute(func() (interface{}, error) {
@@ -63,11 +67,11 @@ func TestCircuitBreakerClosedState(t *testing.T) {
 	assert.Equal(t, gobreaker.StateClosed, breaker.breaker.State())
 
 	expected := `
-# HELP auth_circuit_breaker_state State of the authorization circuit breaker
+# HELP auth_circuit_breaker_state State of the circuit breaker
 # TYPE auth_circuit_breaker_state gauge
-auth_circuit_breaker_state{state="closed"} 1
-auth_circuit_breaker_state{state="half-open"} 0
-auth_circuit_breaker_state{state="open"} 0
+auth_circuit_breaker_state{name="closed",state="closed"} 1
+auth_circuit_breaker_state{name="closed",state="half-open"} 0
+auth_circuit_breaker_state{name="closed",state="open"} 0
 `
 
 	if err := testutil.CollectAndCompare(cbStateGauge, strings.NewReader(expected), "auth_circuit_breaker_state"); err != nil {
@@ -77,11 +81,11 @@ auth_circuit_breaker_state{state="open"} 0
 	expectedCountMetric := `
 # HELP auth_circuit_breaker_count Circuit breaker request count
 # TYPE auth_circuit_breaker_count gauge
-auth_circuit_breaker_count{type="consecutive_failures"} 0
-auth_circuit_breaker_count{type="consecutive_successes"} 10
-auth_circuit_breaker_count{type="requests"} 10
-auth_circuit_breaker_count{type="total_failures"} 0
-auth_circuit_breaker_count{type="total_successes"} 10
+auth_circuit_breaker_count{name="closed",type="consecutive_failures"} 0
+auth_circuit_breaker_count{name="closed",type="consecutive_successes"} 10
+auth_circuit_breaker_count{name="closed",type="requests"} 10
+auth_circuit_breaker_count{name="closed",type="total_failures"} 0
+auth_circuit_breaker_count{name="closed",type="total_successes"} 10
 `
 
 	if err := testutil.CollectAndCompare(cbCounterGauge, strings.NewReader(expectedCountMetric), "auth_circuit_breaker_count"); err != nil {
@@ -89,11 +93,55 @@ auth_circuit_breaker_count{type="total_successes"} 10
 	}
 }
 
+func TestCircuitBreakersDoNotOverwriteEachOthersMetrics(t *testing.T) {
+
+	vault := NewCircuitBreaker("vault-test")
+	oidc := NewCircuitBreaker("oidc-test")
+
+	for i := 0; i < 10; i++ {
+		vault.Execute(func() (interface{}, error) {
+			return nil, errors.New("something went wrong")
+		})
+		oidc.Execute(func() (interface{}, error) {
+			return "okay", nil
+		})
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cbStateGauge.WithLabelValues("vault-test", "open")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cbStateGauge.WithLabelValues("oidc-test", "open")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cbStateGauge.WithLabelValues("oidc-test", "closed")))
+	assert.Equal(t, float64(10), testutil.ToFloat64(cbCounterGauge.WithLabelValues("oidc-test", "total_successes")))
+
+	vault.Reset()
+	assert.Equal(t, float64(1), testutil.ToFloat64(cbStateGauge.WithLabelValues("vault-test", "closed")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cbStateChangeCount.WithLabelValues("vault-test", "open", "closed")))
+}
+
+func TestCircuitBreakerStateGaugeIsUpdatedOnHalfOpen(t *testing.T) {
+
+	os.Setenv("ASP_CIRCUIT_BREAKER_TIMEOUT", "100ms")
+	defer t.Cleanup(func() {
+		os.Setenv("ASP_CIRCUIT_BREAKER_TIMEOUT", "")
+	})
+
+	breaker := NewCircuitBreaker("half-open")
+	for i := 0; i < 10; i++ {
+		breaker.Execute(func() (interface{}, error) {
+			return nil, errors.New("something went wrong")
+		})
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	assert.Equal(t, gobreaker.StateHalfOpen, breaker.State())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cbStateGauge.WithLabelValues("half-open", "half-open")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cbStateGauge.WithLabelValues("half-open", "open")))
+}
+
 func TestCircuitBreakerFailureThresholdConfigParsing(t *testing.T) {
 
 	os.Setenv("ASP_CIRCUIT_BREAKER_FAILURE_THRESHOLD", "50")
 
-	breaker := NewCircuitBreaker()
+	breaker := NewCircuitBreaker("test")
 
 	for i := 0; i < 10; i++ {
 		breaker.Execute(func() (interface{}, error) {
@@ -113,7 +161,7 @@ func TestCircuitBreakerFailureThresholdConfigParsingWithInvalidValue(t *testing.
 
 	os.Setenv("ASP_CIRCUIT_BREAKER_FAILURE_THRESHOLD", "fifty counts")
 
-	breaker := NewCircuitBreaker()
+	breaker := NewCircuitBreaker("test")
 
 	for i := 0; i <= 5; i++ {
 		breaker.Execute(func() (interface{}, error) {
@@ -133,7 +181,7 @@ func TestCircuitBreakerTimeoutConfigParsing(t *testing.T) {
 
 	os.Setenv("ASP_CIRCUIT_BREAKER_TIMEOUT", "300ms")
 
-	breaker := NewCircuitBreaker()
+	breaker := NewCircuitBreaker("test")
 
 	for i := 0; i < 10; i++ {
 		breaker.Execute(func() (interface{}, error) {
@@ -154,7 +202,7 @@ func TestCircuitBreakerTimeoutConfigParsingWithInvalidValue(t *testing.T) {
 
 	os.Setenv("ASP_CIRCUIT_BREAKER_TIMEOUT", "3000 mega fonzies")
 
-	breaker := NewCircuitBreaker()
+	breaker := NewCircuitBreaker("test")
 
 	for i := 0; i < 10; i++ {
 		breaker.Execute(func() (interface{}, error) {
@@ -172,3 +220,97 @@ func TestGetEnvOrFallback(t *testing.T) {
 	assert.Equal(t, expected, want)
 
 }
+
+func resetMetrics() {
+	cbStateGauge.Reset()
+	cbCounterGauge.Reset()
+}
+
+func TestCircuitBreakerTripsOnFailureRatio(t *testing.T) {
+
+	breaker := NewCircuitBreakerWithSettings("ratio", Settings{
+		Timeout:          time.Minute,
+		FailureThreshold: 100,
+		FailureRatio:     0.5,
+		MinRequests:      10,
+	})
+
+	for i := 0; i < 9; i++ {
+		breaker.Execute(func() (interface{}, error) {
+			if i%2 == 0 {
+				return nil, errors.New("something went wrong")
+			}
+			return "okay", nil
+		})
+	}
+	assert.Equal(t, gobreaker.StateClosed, breaker.State())
+
+	breaker.Execute(func() (interface{}, error) {
+		return nil, errors.New("something went wrong")
+	})
+	assert.Equal(t, gobreaker.StateOpen, breaker.State())
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+
+	breaker := NewCircuitBreakerWithSettings("client-errors", Settings{Timeout: time.Minute, FailureThreshold: 2})
+
+	for i := 0; i < 10; i++ {
+		_, err := breaker.Execute(func() (interface{}, error) {
+			return nil, NewStatusError(403, "permission denied")
+		})
+		assert.True(t, IsClientError(err))
+	}
+	assert.Equal(t, gobreaker.StateClosed, breaker.State())
+
+	for i := 0; i < 3; i++ {
+		breaker.Execute(func() (interface{}, error) {
+			return nil, NewStatusError(503, "service unavailable")
+		})
+	}
+	assert.Equal(t, gobreaker.StateOpen, breaker.State())
+}
+
+func TestCircuitBreakerLetsMaxHalfOpenRequestsThrough(t *testing.T) {
+
+	breaker := NewCircuitBreakerWithSettings("half-open-probes", Settings{
+		Timeout:             50 * time.Millisecond,
+		MaxHalfOpenRequests: 3,
+		FailureThreshold:    0,
+	})
+
+	breaker.Execute(func() (interface{}, error) {
+		return nil, errors.New("something went wrong")
+	})
+	assert.Equal(t, gobreaker.StateOpen, breaker.State())
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, gobreaker.StateHalfOpen, breaker.State())
+
+	for i := 0; i < 2; i++ {
+		_, err := breaker.Execute(func() (interface{}, error) {
+			return "okay", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, gobreaker.StateHalfOpen, breaker.State())
+	}
+
+	breaker.Execute(func() (interface{}, error) {
+		return "okay", nil
+	})
+	assert.Equal(t, gobreaker.StateClosed, breaker.State())
+}
+
+func TestUpstreamCircuitBreakerHasItsOwnMetrics(t *testing.T) {
+	resetMetrics()
+
+	breaker := NewUpstreamCircuitBreaker("upstream-test", Settings{Timeout: time.Minute, FailureThreshold: 0})
+	done, err := breaker.Allow()
+	assert.NoError(t, err)
+	done(false)
+
+	assert.Equal(t, gobreaker.StateOpen, breaker.State())
+	assert.Equal(t, float64(1), testutil.ToFloat64(upstreamStateGauge.WithLabelValues("upstream-test", "open")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(upstreamStateChangeCount.WithLabelValues("upstream-test", "closed", "open")))
+	assert.Equal(t, 0, testutil.CollectAndCount(cbStateGauge), "the auth circuit breaker metrics must not contain the upstream breaker")
+}
@@ -0,0 +1,29 @@
+package circuitbreaker
+
+import (
+	"errors"
+)
+
+// StatusError is returned by the http clients of the credentials providers for answers with an error status code
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func NewStatusError(statusCode int, message string) *StatusError {
+	return &StatusError{StatusCode: statusCode, Message: message}
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// IsClientError reports whether the error was caused by a 4xx answer, e.g. a denied Vault token or invalid client credentials.
+// Such errors are not caused by an unavailable server, so they do not trip the circuit breaker.
+func IsClientError(err error) bool {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= 400 && statusError.StatusCode < 500
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Version is the version of the config file format understood by the proxy
+const Version = 1
+
+var keysTemplate = template.Must(template.New("keys").Parse("{{range .}}{{.Key}} {{.Name}}\n{{end}}"))
+
+// Load decodes a YAML or JSON config file into document, a pointer to a struct whose settings are named by their yaml tag.
+// The file has to declare its version. Unknown keys, keys given twice and invalid values are rejected, every problem
+// found in the file is reported at once as *ValidationError. The valid settings are decoded nevertheless.
+func Load(path string, document interface{}) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// JSON is a subset of YAML, so both are read the same way
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	if len(root.Content) > 0 {
+		mapping = root.Content[0]
+	}
+	if mapping.Kind != yaml.MappingNode {
+		return fmt.Errorf("failed parsing %s: expected a mapping of settings", path)
+	}
+
+	problems := &ValidationError{}
+	if version := lookup(mapping, "version"); version == nil {
+		problems.Addf("version: missing, the current version is %d", Version)
+		return problems
+	} else if version.Value != fmt.Sprint(Version) {
+		problems.Addf("version: unsupported version %s, the current version is %d", version.Value, Version)
+		return problems
+	}
+
+	decode(mapping, reflect.ValueOf(document).Elem(), "", problems)
+	return problems.ErrorOrNil()
+}
+
+func lookup(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// decode sets value from the node and reports whether it succeeded. The path is the key as written in the file, e.g. circuit_breaker.timeout.
+func decode(node *yaml.Node, value reflect.Value, path string, problems *ValidationError) bool {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		// an empty value leaves the setting unset
+		return false
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		element := reflect.New(value.Type().Elem())
+		if !decode(node, element.Elem(), path, problems) {
+			return false
+		}
+		value.Set(element)
+		return true
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			problems.Addf("%s: expected a mapping", path)
+			return false
+		}
+		locations := map[string]int{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			if line, ok := locations[key]; ok {
+				problems.Addf("%s: set more than once, in line %d and in line %d", keyPath, line, node.Content[i].Line)
+				continue
+			}
+			locations[key] = node.Content[i].Line
+
+			field, ok := fieldByKey(value, key)
+			if !ok {
+				problems.Addf("%s: unknown setting", keyPath)
+				continue
+			}
+			decode(node.Content[i+1], field, keyPath, problems)
+		}
+		return true
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			problems.Addf("%s: expected %s", path, describe(value.Type()))
+			return false
+		}
+		list := reflect.MakeSlice(value.Type(), 0, len(node.Content))
+		for i, elementNode := range node.Content {
+			element := reflect.New(value.Type().Elem()).Elem()
+			if decode(elementNode, element, fmt.Sprintf("%s[%d]", path, i), problems) {
+				list = reflect.Append(list, element)
+			}
+		}
+		value.Set(list)
+		return true
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		problems.Addf("%s: expected %s", path, describe(value.Type()))
+		return false
+	}
+	if err := node.Decode(value.Addr().Interface()); err != nil {
+		problems.Addf("%s: invalid value %q, expected %s", path, node.Value, describe(value.Type()))
+		return false
+	}
+	return true
+}
+
+func fieldByKey(value reflect.Value, key string) (reflect.Value, bool) {
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" && name == key {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func describe(valueType reflect.Type) string {
+	if valueType == reflect.TypeOf(time.Duration(0)) {
+		return "a duration like 30s"
+	}
+	switch valueType.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a positive integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Struct:
+		return "a mapping"
+	case reflect.Ptr:
+		return describe(valueType.Elem())
+	}
+	return "a " + valueType.String()
+}
+
+// Schema knows the fields of a struct processed by envconfig and the environment variables they are read from
+type Schema struct {
+	fields map[string]string
+}
+
+// NewSchema derives the schema from a struct processed by envconfig
+func NewSchema(prefix string, spec interface{}) (*Schema, error) {
+	var out bytes.Buffer
+	if err := envconfig.Usaget(prefix, spec, &out, keysTemplate); err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{fields: map[string]string{}}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		keyAndName := strings.Fields(line)
+		if len(keyAndName) == 2 {
+			schema.fields[keyAndName[0]] = keyAndName[1]
+		}
+	}
+	return schema, nil
+}
+
+// Apply copies the settings of a loaded document onto spec. A setting tagged with env, e.g. env:"ASP_TARGET_URL", is
+// only copied if that environment variable is not set, so the environment overrides the file. These settings have to be
+// pointers, unset ones are nil. Settings without env tag only exist in the file and are left to the caller.
+// The environment is only read, it is never changed.
+func (s *Schema) Apply(document interface{}, spec interface{}) error {
+	return s.apply(reflect.ValueOf(document).Elem(), reflect.ValueOf(spec).Elem())
+}
+
+func (s *Schema) apply(document reflect.Value, spec reflect.Value) error {
+	for i := 0; i < document.NumField(); i++ {
+		field := document.Type().Field(i)
+		value := document.Field(i)
+
+		key, ok := field.Tag.Lookup("env")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				if err := s.apply(value, spec); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		name, ok := s.fields[key]
+		if !ok {
+			return fmt.Errorf("%s: not an environment variable of the schema", key)
+		}
+		target := spec.FieldByName(name)
+		if field.Type.Kind() != reflect.Ptr || !field.Type.Elem().AssignableTo(target.Type()) {
+			return fmt.Errorf("%s: a %s cannot be applied to %s", key, field.Type, target.Type())
+		}
+		if value.IsNil() {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		target.Set(value.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testSpec struct {
+	TargetUrl                 string        `split_words:"true"`
+	Port                      int           `default:"8080"`
+	CircuitBreakerTimeout     time.Duration `split_words:"true" default:"60s"`
+	CircuitBreakerMinRequests uint32        `split_words:"true" default:"10"`
+	AccessLog                 bool          `split_words:"true" default:"false"`
+	MetricsRoutes             []string      `split_words:"true"`
+	Targets                   []testTarget  `ignored:"true"`
+}
+
+type testTarget struct {
+	Url    string `yaml:"url"`
+	Region string `yaml:"region"`
+}
+
+type testDocument struct {
+	Version        int                `yaml:"version"`
+	TargetUrl      *string            `yaml:"target_url" env:"ASP_TARGET_URL"`
+	Port           *int               `yaml:"port" env:"ASP_PORT"`
+	CircuitBreaker testCircuitBreaker `yaml:"circuit_breaker"`
+	AccessLog      *bool              `yaml:"access_log" env:"ASP_ACCESS_LOG"`
+	MetricsRoutes  *[]string          `yaml:"metrics_routes" env:"ASP_METRICS_ROUTES"`
+	Targets        []testTarget       `yaml:"targets"`
+}
+
+type testCircuitBreaker struct {
+	Timeout     *time.Duration `yaml:"timeout" env:"ASP_CIRCUIT_BREAKER_TIMEOUT"`
+	MinRequests *uint32        `yaml:"min_requests" env:"ASP_CIRCUIT_BREAKER_MIN_REQUESTS"`
+}
+
+func testSchema(t *testing.T) *Schema {
+	schema, err := NewSchema("ASP", &testSpec{})
+	assert.NoError(t, err)
+	return schema
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadYaml(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+version: 1
+target_url: https://search.eu-central-1.es.amazonaws.com
+port: 9090
+access_log: true
+metrics_routes:
+  - /{index}/_search
+  - /_cluster/health,/_cat/indices
+circuit_breaker:
+  timeout: 10s
+  min_requests: 5
+targets:
+  - url: https://search.eu-west-1.es.amazonaws.com
+    region: eu-west-1
+`)
+
+	var document testDocument
+	err := Load(path, &document)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://search.eu-central-1.es.amazonaws.com", *document.TargetUrl)
+	assert.Equal(t, 9090, *document.Port)
+	assert.True(t, *document.AccessLog)
+	// list elements may contain commas, unlike comma separated environment variables
+	assert.Equal(t, []string{"/{index}/_search", "/_cluster/health,/_cat/indices"}, *document.MetricsRoutes)
+	assert.Equal(t, 10*time.Second, *document.CircuitBreaker.Timeout)
+	assert.Equal(t, uint32(5), *document.CircuitBreaker.MinRequests)
+	assert.Equal(t, []testTarget{{Url: "https://search.eu-west-1.es.amazonaws.com", Region: "eu-west-1"}}, document.Targets)
+}
+
+func TestLoadJson(t *testing.T) {
+	path := writeFile(t, "config.json", "{\n\t\"version\": 1,\n\t\"target_url\": \"https://search.eu-central-1.es.amazonaws.com\",\n\t\"port\": 9090,\n\t\"circuit_breaker\": {\"timeout\": \"10s\"}\n}\n")
+
+	var document testDocument
+	err := Load(path, &document)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 9090, *document.Port)
+	assert.Equal(t, 10*time.Second, *document.CircuitBreaker.Timeout)
+	assert.Nil(t, document.AccessLog)
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+version: 1
+target_url: https://search.eu-central-1.es.amazonaws.com
+port: eighty
+circuit_breaker:
+  min_requests: -1
+  timout: 10s
+  timeout: 30
+metrics_routes: /_cluster/health
+targets:
+  - url: https://search.eu-west-1.es.amazonaws.com
+    zone: eu-west-1a
+`)
+
+	var document testDocument
+	err := Load(path, &document)
+
+	var validationError *ValidationError
+	if assert.True(t, errors.As(err, &validationError)) {
+		assert.Equal(t, []string{
+			"port: invalid value \"eighty\", expected an integer",
+			"circuit_breaker.min_requests: invalid value \"-1\", expected a positive integer",
+			"circuit_breaker.timout: unknown setting",
+			"circuit_breaker.timeout: invalid value \"30\", expected a duration like 30s",
+			"metrics_routes: expected a list",
+			"targets[0].zone: unknown setting",
+		}, messages(validationError))
+	}
+	assert.Contains(t, err.Error(), "6 problems found:")
+	// valid settings are still available
+	assert.Equal(t, "https://search.eu-central-1.es.amazonaws.com", *document.TargetUrl)
+	assert.Nil(t, document.Port)
+}
+
+func TestLoadRejectsSettingsGivenTwice(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+version: 1
+circuit_breaker:
+  timeout: 10s
+  timeout: 20s
+port: 8080
+port: 9090
+`)
+
+	var document testDocument
+	err := Load(path, &document)
+
+	var validationError *ValidationError
+	if assert.True(t, errors.As(err, &validationError)) {
+		assert.Equal(t, []string{
+			"circuit_breaker.timeout: set more than once, in line 4 and in line 5",
+			"port: set more than once, in line 6 and in line 7",
+		}, messages(validationError))
+	}
+}
+
+func TestLoadRequiresVersion(t *testing.T) {
+	var document testDocument
+
+	err := Load(writeFile(t, "config.yaml", "port: 9090\n"), &document)
+	assert.EqualError(t, err, "version: missing, the current version is 1")
+
+	err = Load(writeFile(t, "config.yaml", "version: 2\nport: 9090\n"), &document)
+	assert.EqualError(t, err, "version: unsupported version 2, the current version is 1")
+}
+
+func TestApplyKeepsEnvironment(t *testing.T) {
+	t.Setenv("ASP_PORT", "7070")
+	t.Setenv("ASP_TARGET_URL", "")
+	os.Unsetenv("ASP_TARGET_URL")
+
+	targetUrl, port, timeout := "https://example.com", 9090, 10*time.Second
+	document := &testDocument{
+		TargetUrl:      &targetUrl,
+		Port:           &port,
+		CircuitBreaker: testCircuitBreaker{Timeout: &timeout},
+		Targets:        []testTarget{{Url: "https://failover.example.com"}},
+	}
+	spec := &testSpec{Port: 7070, CircuitBreakerMinRequests: 10}
+	assert.NoError(t, testSchema(t).Apply(document, spec))
+
+	assert.Equal(t, &testSpec{
+		TargetUrl:                 "https://example.com",
+		Port:                      7070,
+		CircuitBreakerTimeout:     10 * time.Second,
+		CircuitBreakerMinRequests: 10,
+	}, spec, "settings of the environment and settings not given in the file are kept, file only settings are left out")
+
+	_, ok := os.LookupEnv("ASP_TARGET_URL")
+	assert.False(t, ok, "the environment is not changed")
+}
+
+func TestApplyRejectsSettingsUnknownToTheSchema(t *testing.T) {
+	document := &struct {
+		Region *string `yaml:"region" env:"ASP_REGION"`
+	}{}
+
+	assert.EqualError(t, testSchema(t).Apply(document, &testSpec{}), "ASP_REGION: not an environment variable of the schema")
+}
+
+func messages(err *ValidationError) []string {
+	var messages []string
+	for _, e := range err.Errors {
+		messages = append(messages, e.Error())
+	}
+	return messages
+}
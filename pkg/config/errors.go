@@ -0,0 +1,51 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ValidationError collects every problem found in a configuration, so all of them can be fixed at once
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%d problems found:", len(e.Errors))
+	for _, err := range e.Errors {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Add records a problem, the problems of another ValidationError are merged
+func (e *ValidationError) Add(err error) {
+	if err == nil {
+		return
+	}
+	var validationError *ValidationError
+	if errors.As(err, &validationError) {
+		e.Errors = append(e.Errors, validationError.Errors...)
+		return
+	}
+	e.Errors = append(e.Errors, err)
+}
+
+func (e *ValidationError) Addf(format string, args ...interface{}) {
+	e.Add(fmt.Errorf(format, args...))
+}
+
+// ErrorOrNil returns nil if no problem has been recorded, so callers do not return a non-nil error interface by accident
+func (e *ValidationError) ErrorOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,78 @@
+package testhelper
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// WithoutEnvironmentCredentials makes sure the credentials chain cannot pick up the credentials of the machine running the tests
+func WithoutEnvironmentCredentials(t *testing.T) {
+	for _, envVar := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_PROFILE"} {
+		t.Setenv(envVar, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent/aws-credentials")
+}
+
+// ReadClient hands out credentials which expire after ExpiresIn, an hour by default.
+// Every fetch takes Delay and fails while the client is failing.
+type ReadClient struct {
+	AccessKey string
+	ExpiresIn time.Duration
+	Delay     time.Duration
+	Failing   bool
+
+	mutex sync.Mutex
+	calls int
+}
+
+// RefreshCredentials fills in the result like a proxy.RefreshedCredentials decoded from a vault response, which
+// is done via JSON, since the tests of the proxy package cannot import it.
+func (m *ReadClient) RefreshCredentials(result interface{}) error {
+	time.Sleep(m.Delay)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.calls++
+	if m.Failing {
+		return errors.New("credentials provider unavailable")
+	}
+
+	accessKey := m.AccessKey
+	if accessKey == "" {
+		accessKey = "accessKey"
+	}
+	expiresIn := m.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = time.Hour
+	}
+
+	refreshedCredentials, err := json.Marshal(map[string]interface{}{
+		"expires_at": time.Now().Add(expiresIn),
+		"data": map[string]string{
+			"access_key":     accessKey,
+			"secret_key":     "secretKey",
+			"security_token": "securityToken",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(refreshedCredentials, result)
+}
+
+func (m *ReadClient) SetFailing(failing bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Failing = failing
+}
+
+// Calls returns how often credentials were fetched
+func (m *ReadClient) Calls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls
+}
@@ -1,6 +1,8 @@
 package irsa
 
 import (
+	"context"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -8,22 +10,30 @@ import (
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	. "github.com/idealo/aws-signing-proxy/pkg/logging"
 	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/idealo/aws-signing-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"os"
+	"sync"
 	"time"
 )
 
-var cachedCredentials *sts.Credentials
+const tracerName = "github.com/idealo/aws-signing-proxy/pkg/irsa"
 
 type ReadClient struct {
 	stsClient stsiface.STSAPI
 	clientId  string
 	roleArn   string
+
+	mutex             sync.Mutex
+	cachedCredentials *sts.Credentials
 }
 
-func NewIRSAClient(region string, clientId string, roleArn string) *ReadClient {
+// NewIRSAClient creates a client which exchanges the web identity token for credentials at STS.
+// The configs customize the STS client, e.g. its http.Client.
+func NewIRSAClient(region string, clientId string, roleArn string, configs ...*aws.Config) *ReadClient {
 	return &ReadClient{
-		stsClient: InitClient(region),
+		stsClient: InitClient(region, configs...),
 		clientId:  clientId,
 		roleArn:   roleArn,
 	}
@@ -34,7 +44,7 @@ func (c *ReadClient) WithRoleArn(roleArn string) *ReadClient {
 	return c
 }
 
-func (c *ReadClient) retrieveShortLivingCredentialsFromAwsSts(roleArn string, webToken string, roleSessionName string) *sts.Credentials {
+func (c *ReadClient) retrieveShortLivingCredentialsFromAwsSts(roleArn string, webToken string, roleSessionName string) (*sts.Credentials, error) {
 	identity, err := c.stsClient.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
 		RoleArn:          &roleArn,
 		RoleSessionName:  &roleSessionName,
@@ -43,28 +53,37 @@ func (c *ReadClient) retrieveShortLivingCredentialsFromAwsSts(roleArn string, we
 
 	if err != nil {
 		Logger.Error("Something went wrong with the STS Client", zap.Error(err))
+		return nil, err
+	}
+	if identity.Credentials == nil {
+		return nil, errors.New("AWS STS did not return any credentials")
 	}
 
-	return identity.Credentials
+	return identity.Credentials, nil
 }
 
-func InitClient(region string) stsiface.STSAPI {
+// InitClient creates an anonymous STS client, the configs are merged in order
+func InitClient(region string, configs ...*aws.Config) stsiface.STSAPI {
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region:      aws.String(region),
 		Credentials: credentials.AnonymousCredentials},
 	))
 
-	return sts.New(sess, aws.NewConfig().WithRegion(region))
+	return sts.New(sess, append([]*aws.Config{aws.NewConfig().WithRegion(region)}, configs...)...)
 }
 
 func (c *ReadClient) RefreshCredentials(result interface{}) error {
+	return c.RefreshCredentialsWithContext(context.Background(), result)
+}
+
+// RefreshCredentialsWithContext traces fetching new credentials as part of the request in the context
+func (c *ReadClient) RefreshCredentialsWithContext(ctx context.Context, result interface{}) error {
 	refreshedCredentials := result.(*proxy.RefreshedCredentials)
 
-	err := RetrieveCredentials(c)
+	stsCredentials, err := c.credentials(ctx)
 	if err != nil {
 		return err
 	}
-	stsCredentials := cachedCredentials
 
 	refreshedCredentials.ExpiresAt = *stsCredentials.Expiration
 	refreshedCredentials.Data.AccessKey = *stsCredentials.AccessKeyId
@@ -74,23 +93,58 @@ func (c *ReadClient) RefreshCredentials(result interface{}) error {
 	return nil
 }
 
+// ExpireCredentials drops the cached credentials, so the next refresh fetches new ones
+func (c *ReadClient) ExpireCredentials() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cachedCredentials = nil
+}
+
+func (c *ReadClient) Name() string {
+	return "irsa"
+}
+
 func RetrieveCredentials(c *ReadClient) error {
-	if cachedCredentials == nil || isExpired(cachedCredentials.Expiration) {
+	_, err := c.credentials(context.Background())
+	return err
+}
 
-		tokenFile, ok := os.LookupEnv("AWS_WEB_IDENTITY_TOKEN_FILE")
-		if !ok {
-			zap.S().Fatalf("Environment variable 'AWS_WEB_IDENTITY_TOKEN_FILE' is not set!")
-		}
+// credentials returns the cached credentials of this client and refreshes them ahead of their expiry.
+// Concurrent callers wait for a single refresh instead of hitting AWS STS in parallel.
+func (c *ReadClient) credentials(ctx context.Context) (*sts.Credentials, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cachedCredentials == nil || isExpired(c.cachedCredentials.Expiration) {
 
-		bytes, err := os.ReadFile(tokenFile)
+		start := time.Now()
+		stsCredentials, err := c.fetchCredentials(ctx)
+		proxy.ObserveRefresh(c.Name(), start, err)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		c.cachedCredentials = stsCredentials
+		Logger.Info("Refreshed short living credentials.", zap.String("role-arn", c.roleArn))
+	}
+	return c.cachedCredentials, nil
+}
 
-		cachedCredentials = c.retrieveShortLivingCredentialsFromAwsSts(c.roleArn, string(bytes), c.clientId)
-		Logger.Info("Refreshed short living credentials.")
+// fetchCredentials exchanges the web identity token for new short living credentials
+func (c *ReadClient) fetchCredentials(ctx context.Context) (*sts.Credentials, error) {
+	tokenFile, ok := os.LookupEnv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if !ok {
+		zap.S().Fatalf("Environment variable 'AWS_WEB_IDENTITY_TOKEN_FILE' is not set!")
 	}
-	return nil
+
+	bytes, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := otel.Tracer(tracerName).Start(ctx, "sts.AssumeRoleWithWebIdentity")
+	stsCredentials, err := c.retrieveShortLivingCredentialsFromAwsSts(c.roleArn, string(bytes), c.clientId)
+	tracing.End(span, err)
+	return stsCredentials, err
 }
 
 func isExpired(expiration *time.Time) bool {
@@ -3,8 +3,10 @@ package irsa
 import (
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -35,9 +37,9 @@ func TestRetrieveCredentialsAheadOfTime(t *testing.T) {
 		SessionToken:    &sessionToken,
 	}
 
-	got := cachedCredentials
+	got := readClient.cachedCredentials
 
-	if !reflect.DeepEqual(cachedCredentials, want) {
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("RetrieveCredentials() = %v, want %v", got, want)
 	}
 
@@ -60,13 +62,51 @@ func TestRetrieveShortLivingCredentials(t *testing.T) {
 		SecretAccessKey: &secretAccessKey,
 		SessionToken:    &sessionToken,
 	}
-	got := client.retrieveShortLivingCredentialsFromAwsSts("foo", "bar", "session")
+	got, err := client.retrieveShortLivingCredentialsFromAwsSts("foo", "bar", "session")
 
-	if !reflect.DeepEqual(got, want) {
+	if err != nil || !reflect.DeepEqual(got, want) {
 		t.Errorf("retrieveShortLivingCredentialsFromAwsSts() = %v, want %v", got, want)
 	}
 }
 
+func TestConcurrentClientsKeepSeparateCredentials(t *testing.T) {
+
+	tmpToken, _ := os.CreateTemp("", "aws-irsa-token-file")
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tmpToken.Name())
+
+	stsClient := &roleAwareStsClient{calls: map[string]int{}}
+	roles := []string{"role-a", "role-b", "role-c"}
+	clients := make([]*ReadClient, len(roles))
+	for i, role := range roles {
+		clients[i] = &ReadClient{stsClient: stsClient, clientId: "client_id", roleArn: role}
+	}
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		for j := 0; j < 20; j++ {
+			wg.Add(1)
+			go func(client *ReadClient, role string) {
+				defer wg.Done()
+				rc := &proxy.RefreshedCredentials{}
+				if err := client.RefreshCredentials(rc); err != nil {
+					t.Error(err)
+					return
+				}
+				if rc.Data.AccessKey != role {
+					t.Errorf("client for %s got credentials of %s", role, rc.Data.AccessKey)
+				}
+			}(clients[i], roles[i])
+		}
+	}
+	wg.Wait()
+
+	for _, role := range roles {
+		if stsClient.calls[role] != 1 {
+			t.Errorf("expected a single STS call for %s, got %d", role, stsClient.calls[role])
+		}
+	}
+}
+
 type mockStsClient struct {
 	stsiface.STSAPI
 }
@@ -87,3 +127,26 @@ func (*mockStsClient) AssumeRoleWithWebIdentity(*sts.AssumeRoleWithWebIdentityIn
 		},
 	}, nil
 }
+
+// roleAwareStsClient returns credentials whose access key id is the assumed role and counts the calls per role
+type roleAwareStsClient struct {
+	stsiface.STSAPI
+	mutex sync.Mutex
+	calls map[string]int
+}
+
+func (m *roleAwareStsClient) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	m.mutex.Lock()
+	m.calls[*input.RoleArn]++
+	m.mutex.Unlock()
+
+	expiration := time.Now().Add(time.Hour)
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     input.RoleArn,
+			Expiration:      &expiration,
+			SecretAccessKey: input.RoleArn,
+			SessionToken:    input.RoleArn,
+		},
+	}, nil
+}
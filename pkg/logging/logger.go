@@ -1,15 +1,78 @@
 package logging
 
 import (
+	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"os"
 	"time"
 )
 
+// Level is the level of the Logger. It can be changed at runtime, e.g. through the admin endpoint.
+var Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
 var Logger, _ = InitLogging()
 
+type LogConfig struct {
+	// Level is one of debug, info, warn or error
+	Level string
+	// Encoding is either json or console
+	Encoding string
+	// SamplingInitial is the number of identical messages logged per second before sampling starts, 0 disables sampling
+	SamplingInitial int
+	// SamplingThereafter logs every nth identical message once sampling has started
+	SamplingThereafter int
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		Level:              "info",
+		Encoding:           "json",
+		SamplingInitial:    100,
+		SamplingThereafter: 100,
+	}
+}
+
 func InitLogging() (*zap.Logger, error) {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
-	return config.Build()
+	return NewLogger(DefaultLogConfig())
+}
+
+// NewLogger builds a logger writing to stderr which redacts secrets and sets Level to the configured level
+func NewLogger(config LogConfig) (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
+
+	var encoder zapcore.Encoder
+	switch config.Encoding {
+	case "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("unknown log encoding %q, expected json or console", config.Encoding)
+	}
+
+	core := Redact(zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), Level))
+	if config.SamplingInitial > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, config.SamplingInitial, config.SamplingThereafter)
+	}
+
+	Level.SetLevel(level)
+	return zap.New(core, zap.ErrorOutput(zapcore.Lock(os.Stderr)), zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)), nil
+}
+
+// ConfigureLogging replaces the Logger and the global zap loggers with a logger built from the given config
+func ConfigureLogging(config LogConfig) error {
+	logger, err := NewLogger(config)
+	if err != nil {
+		return err
+	}
+	Logger = logger
+	zap.ReplaceGlobals(logger)
+	return nil
 }
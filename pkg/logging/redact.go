@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are field keys whose values are never logged, compared in lower case with underscores replaced by dashes
+var sensitiveKeys = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"token":               true,
+	"secret":              true,
+	"password":            true,
+	"secret-key":          true,
+	"secret-access-key":   true,
+}
+
+var sensitivePatterns = []*regexp.Regexp{
+	// header values, e.g. "Authorization: Bearer ..." or "Authorization=AWS4-HMAC-SHA256 Credential=..., Signature=..."
+	regexp.MustCompile(`(?i)((?:proxy-)?authorization"?\s*[:=]\s*"?)[^"\n]+`),
+	// tokens and secrets in query strings, form bodies, JSON documents and error messages
+	regexp.MustCompile(`(?i)((?:x-amz-security-token|x-vault-token|security_?token|session_?token|client_secret|id_token|access_token|refresh_token|secret_?access_?key|secret_key|password)"?\s*[:=]\s*"?)[^\s"&,;}]+`),
+	// JSON web tokens, e.g. OIDC ID tokens
+	regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]*`),
+	// Vault tokens
+	regexp.MustCompile(`\bhv[sbr]\.[\w-]{20,}`),
+}
+
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+// RegisterSecret makes sure the given value never appears in logs, e.g. a configured token or client secret
+func RegisterSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values = append(secrets.values, secret)
+}
+
+// RedactString replaces registered secrets, tokens and authorization header values in s
+func RedactString(s string) string {
+	secrets.RLock()
+	for _, secret := range secrets.values {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secrets.RUnlock()
+
+	for _, pattern := range sensitivePatterns {
+		if pattern.NumSubexp() > 0 {
+			s = pattern.ReplaceAllString(s, "${1}"+redacted)
+		} else {
+			s = pattern.ReplaceAllString(s, redacted)
+		}
+	}
+	return s
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ReplaceAll(strings.ToLower(key), "_", "-")
+	return sensitiveKeys[key] || strings.HasSuffix(key, "-token") || strings.HasSuffix(key, "-secret") ||
+		strings.HasSuffix(key, "-password") || strings.HasSuffix(key, "-secret-key")
+}
+
+// Redact wraps a core, so that messages and fields are redacted before they are written.
+// Fields with sensitive keys are dropped completely, strings and errors are scrubbed with RedactString.
+func Redact(core zapcore.Core) zapcore.Core {
+	return &redactingCore{Core: core}
+}
+
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = RedactString(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redactedFields := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		redactedFields[i] = redactField(field)
+	}
+	return redactedFields
+}
+
+func redactField(field zapcore.Field) zapcore.Field {
+	if isSensitiveKey(field.Key) {
+		return zap.String(field.Key, redacted)
+	}
+
+	switch field.Type {
+	case zapcore.StringType:
+		field.String = RedactString(field.String)
+	case zapcore.ByteStringType:
+		return zap.ByteString(field.Key, []byte(RedactString(string(field.Interface.([]byte)))))
+	case zapcore.ErrorType:
+		if err, ok := field.Interface.(error); ok {
+			return zap.String(field.Key, RedactString(err.Error()))
+		}
+	case zapcore.StringerType:
+		if stringer, ok := field.Interface.(fmt.Stringer); ok {
+			if s, ok := stringOf(stringer); ok {
+				return zap.String(field.Key, RedactString(s))
+			}
+		}
+	}
+	return field
+}
+
+// stringOf guards against Stringers panicking on nil receivers, which zap reports in the log line itself
+func stringOf(stringer fmt.Stringer) (s string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return stringer.String(), true
+}
@@ -0,0 +1,144 @@
+package mgmt
+
+import (
+	"crypto/subtle"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+type CircuitBreakerResponse struct {
+	Name    string                       `json:"name"`
+	State   string                       `json:"state"`
+	Counts  map[string]uint32            `json:"counts"`
+	History []circuitbreaker.StateChange `json:"history"`
+}
+
+type RefreshResponse struct {
+	Provider          string `json:"provider"`
+	AccessKeyIdPrefix string `json:"access_key_id_prefix"`
+	ExpiresAt         string `json:"expires_at,omitempty"`
+}
+
+// AdminHandler provides endpoints for operating the proxy during incidents.
+// Every request has to be authenticated with the configured bearer token.
+type AdminHandler struct {
+	token       string
+	credentials *proxy.Credentials
+	breaker     *circuitbreaker.CircuitBreaker
+	mux         *http.ServeMux
+}
+
+func NewAdminHandler(token string, credentials *proxy.Credentials, breaker *circuitbreaker.CircuitBreaker) *AdminHandler {
+	h := &AdminHandler{
+		token:       token,
+		credentials: credentials,
+		breaker:     breaker,
+		mux:         http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/admin/credentials/refresh", h.refreshCredentials)
+	h.mux.HandleFunc("/admin/circuit-breaker", h.circuitBreaker)
+	h.mux.HandleFunc("/admin/circuit-breaker/reset", h.resetCircuitBreaker)
+	h.mux.HandleFunc("/admin/log-level", h.logLevel)
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authenticated(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJson(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *AdminHandler) authenticated(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if h.token == "" || !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// refreshCredentials expires the credentials chain and fetches new credentials immediately
+func (h *AdminHandler) refreshCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	value, err := h.credentials.Refresh()
+	if err != nil {
+		Logger.Error("Forced refresh of the credentials failed", zap.Error(err))
+		writeJson(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+		return
+	}
+	Logger.Info("Credentials have been refreshed via admin endpoint.")
+
+	response := RefreshResponse{
+		Provider:          value.ProviderName,
+		AccessKeyIdPrefix: proxy.RedactAccessKeyId(value.AccessKeyID),
+	}
+	if h.credentials.Provider != nil && value.ProviderName == proxy.CredentialProviderName {
+		response.ExpiresAt = formatTime(h.credentials.Provider.ExpiresAt())
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func (h *AdminHandler) circuitBreaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	if h.breaker == nil {
+		writeJson(w, http.StatusNotFound, errorResponse{Error: "the credentials provider has no circuit breaker"})
+		return
+	}
+
+	writeJson(w, http.StatusOK, h.circuitBreakerResponse())
+}
+
+// resetCircuitBreaker moves the circuit breaker back to the closed state
+func (h *AdminHandler) resetCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	if h.breaker == nil {
+		writeJson(w, http.StatusNotFound, errorResponse{Error: "the credentials provider has no circuit breaker"})
+		return
+	}
+
+	h.breaker.Reset()
+	writeJson(w, http.StatusOK, h.circuitBreakerResponse())
+}
+
+// logLevel returns the current log level on GET and changes it on PUT with e.g. {"level":"debug"}
+func (h *AdminHandler) logLevel(w http.ResponseWriter, r *http.Request) {
+	previous := Level.Level()
+	Level.ServeHTTP(w, r)
+	if current := Level.Level(); current != previous {
+		Logger.Warn("Log level has been changed via admin endpoint.", zap.Stringer("from", previous), zap.Stringer("to", current))
+	}
+}
+
+func (h *AdminHandler) circuitBreakerResponse() CircuitBreakerResponse {
+	counts := h.breaker.Counts()
+	return CircuitBreakerResponse{
+		Name:  h.breaker.Name(),
+		State: h.breaker.State().String(),
+		Counts: map[string]uint32{
+			"requests":              counts.Requests,
+			"total_successes":       counts.TotalSuccesses,
+			"total_failures":        counts.TotalFailures,
+			"consecutive_successes": counts.ConsecutiveSuccesses,
+			"consecutive_failures":  counts.ConsecutiveFailures,
+		},
+		History: h.breaker.History(),
+	}
+}
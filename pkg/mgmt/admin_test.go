@@ -0,0 +1,132 @@
+package mgmt
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cachingReadClient hands out a new access key with every fetch, but caches it until it is expired
+type cachingReadClient struct {
+	mutex   sync.Mutex
+	fetches int
+	cached  bool
+}
+
+func (c *cachingReadClient) RefreshCredentials(result interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.cached {
+		c.fetches++
+		c.cached = true
+	}
+	refreshedCredentials := result.(*proxy.RefreshedCredentials)
+	refreshedCredentials.ExpiresAt = time.Now().Add(time.Hour)
+	refreshedCredentials.Data.AccessKey = "ASIAKEY" + string(rune('0'+c.fetches)) + "EXAMPLE"
+	return nil
+}
+
+func (c *cachingReadClient) ExpireCredentials() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cached = false
+}
+
+func TestAdminEndpointsRequireToken(t *testing.T) {
+
+	handler := NewAdminHandler("s3cr3t", proxy.NewCredentials(&testhelper.ReadClient{}), circuitbreaker.NewCircuitBreaker("test"))
+
+	for _, token := range []string{"", "Bearer wrong", "s3cr3t"} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/circuit-breaker/reset", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, token)
+	}
+}
+
+func TestAdminRefreshCredentials(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	client := &cachingReadClient{}
+	credentials := proxy.NewCredentials(client)
+	before, err := credentials.Get()
+	assert.NoError(t, err)
+
+	rec := adminRequest(NewAdminHandler("s3cr3t", credentials, nil), http.MethodPost, "/admin/credentials/refresh")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	after, err := credentials.Get()
+	assert.NoError(t, err)
+	assert.NotEqual(t, before.AccessKeyID, after.AccessKeyID)
+	assert.Equal(t, 2, client.fetches)
+
+	var response RefreshResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "ASIAKEY2...", response.AccessKeyIdPrefix)
+}
+
+func TestAdminResetCircuitBreaker(t *testing.T) {
+
+	breaker := circuitbreaker.NewCircuitBreaker("test")
+	for i := 0; i < 10; i++ {
+		_, _ = breaker.Execute(func() (interface{}, error) {
+			return nil, errors.New("something went wrong")
+		})
+	}
+	handler := NewAdminHandler("s3cr3t", proxy.NewCredentials(nil), breaker)
+
+	rec := adminRequest(handler, http.MethodGet, "/admin/circuit-breaker")
+	var response CircuitBreakerResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "open", response.State)
+	assert.Equal(t, uint32(0), response.Counts["requests"])
+
+	rec = adminRequest(handler, http.MethodPost, "/admin/circuit-breaker/reset")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "closed", response.State)
+	assert.Len(t, response.History, 2)
+	assert.Equal(t, "open", response.History[0].To)
+	assert.Equal(t, "closed", response.History[1].To)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(handler, http.MethodGet, "/admin/circuit-breaker/reset").Code)
+}
+
+func adminRequest(handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminChangesLogLevel(t *testing.T) {
+	defer Level.SetLevel(zapcore.InfoLevel)
+
+	handler := NewAdminHandler("s3cr3t", proxy.NewCredentials(&testhelper.ReadClient{}), nil)
+
+	req := httptest.NewRequest(http.MethodPut, "/admin/log-level", strings.NewReader(`{"level":"debug"}`))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"level":"debug"}`, rec.Body.String())
+	assert.Equal(t, zapcore.DebugLevel, Level.Level())
+}
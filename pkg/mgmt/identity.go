@@ -0,0 +1,99 @@
+package mgmt
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+type IdentityResponse struct {
+	Arn               string `json:"arn"`
+	Account           string `json:"account"`
+	UserId            string `json:"user_id"`
+	Provider          string `json:"provider"`
+	AccessKeyIdPrefix string `json:"access_key_id_prefix"`
+	ExpiresAt         string `json:"expires_at,omitempty"`
+	LastRefresh       string `json:"last_refresh,omitempty"`
+}
+
+// IdentityHandler tells which principal the proxy is signing as by calling sts:GetCallerIdentity
+// with the credentials used for signing. Secrets are never part of the response.
+type IdentityHandler struct {
+	credentials  *proxy.Credentials
+	providerName string
+	stsClient    stsiface.STSAPI
+}
+
+// NewIdentityHandler creates the handler, the configs customize the STS client, e.g. its http.Client
+func NewIdentityHandler(credentials *proxy.Credentials, providerName string, region string, configs ...*aws.Config) *IdentityHandler {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Credentials: credentials.Credentials,
+	}))
+
+	return &IdentityHandler{
+		credentials:  credentials,
+		providerName: providerName,
+		stsClient:    sts.New(sess, configs...),
+	}
+}
+
+func (h *IdentityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	value, err := h.credentials.GetWithContext(r.Context())
+	if err != nil {
+		writeJson(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+		return
+	}
+
+	identity, err := h.stsClient.GetCallerIdentityWithContext(r.Context(), &sts.GetCallerIdentityInput{})
+	if err != nil {
+		Logger.Error("Retrieving the caller identity failed", zap.Error(err))
+		writeJson(w, http.StatusBadGateway, errorResponse{Error: err.Error()})
+		return
+	}
+
+	response := IdentityResponse{
+		Arn:               aws.StringValue(identity.Arn),
+		Account:           aws.StringValue(identity.Account),
+		UserId:            aws.StringValue(identity.UserId),
+		Provider:          value.ProviderName,
+		AccessKeyIdPrefix: proxy.RedactAccessKeyId(value.AccessKeyID),
+	}
+
+	if h.credentials.Provider != nil && value.ProviderName == proxy.CredentialProviderName {
+		response.Provider = h.providerName
+		response.ExpiresAt = formatTime(h.credentials.Provider.ExpiresAt())
+		response.LastRefresh = formatTime(h.credentials.Provider.LastRefresh())
+	}
+
+	writeJson(w, http.StatusOK, response)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,166 @@
+package mgmt
+
+import (
+	"context"
+	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/sony/gobreaker"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOk          = "ok"
+	StatusFailing     = "failing"
+	StatusUnavailable = "unavailable"
+	StatusDraining    = "draining"
+)
+
+// Check is a single component check of the readiness endpoint.
+// A failing required check makes the whole endpoint answer with 503.
+type Check struct {
+	Name     string
+	Required bool
+	Run      func() CheckResult
+}
+
+type CheckResult struct {
+	Status  string                 `json:"status"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// ReadinessHandler reports the state of all checks on the readiness endpoint
+type ReadinessHandler struct {
+	checks   []Check
+	draining atomic.Bool
+}
+
+func NewReadinessHandler(checks ...Check) *ReadinessHandler {
+	return &ReadinessHandler{checks: checks}
+}
+
+// Drain makes the readiness endpoint fail for good, so no new requests are routed to the proxy while it shuts down
+func (h *ReadinessHandler) Drain() {
+	h.draining.Store(true)
+}
+
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	response := ReadinessResponse{
+		Status: StatusOk,
+		Checks: map[string]CheckResult{},
+	}
+
+	if h.draining.Load() {
+		response.Status = StatusDraining
+		writeJson(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	for _, check := range h.checks {
+		result := check.Run()
+		response.Checks[check.Name] = result
+		if check.Required && result.Status != StatusOk {
+			response.Status = StatusUnavailable
+		}
+	}
+
+	status := http.StatusOK
+	if response.Status != StatusOk {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJson(w, status, response)
+}
+
+// CredentialsCheck fails if no credentials can be retrieved and reports the time until they expire
+func CredentialsCheck(creds *proxy.Credentials) Check {
+	return Check{
+		Name:     "credentials",
+		Required: true,
+		Run: func() CheckResult {
+			value, err := creds.Get()
+			if err != nil {
+				return CheckResult{Status: StatusFailing, Error: err.Error()}
+			}
+
+			details := map[string]interface{}{
+				"provider": value.ProviderName,
+			}
+			if creds.Provider != nil && value.ProviderName == proxy.CredentialProviderName {
+				expiresAt := creds.Provider.ExpiresAt()
+				details["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+				details["expires_in_seconds"] = int64(time.Until(expiresAt).Seconds())
+			}
+			return CheckResult{Status: StatusOk, Details: details}
+		},
+	}
+}
+
+// CircuitBreakerCheck reports the state of the circuit breaker of the credentials provider.
+// It is not required, since the last known good credentials are used while the circuit is open.
+func CircuitBreakerCheck(breaker *circuitbreaker.CircuitBreaker) Check {
+	return Check{
+		Name:     "circuit_breaker",
+		Required: false,
+		Run: func() CheckResult {
+			state := breaker.State()
+			result := CheckResult{
+				Status: StatusOk,
+				Details: map[string]interface{}{
+					"name":  breaker.Name(),
+					"state": state.String(),
+				},
+			}
+			if state == gobreaker.StateOpen {
+				result.Status = StatusFailing
+			}
+			return result
+		},
+	}
+}
+
+// UpstreamCheck sends a signed GET request to the probe url through the signing transport.
+// The upstream is considered unhealthy if it cannot be reached or answers with a 5xx status code.
+func UpstreamCheck(transport http.RoundTripper, probeUrl string, timeout time.Duration) Check {
+	return Check{
+		Name:     "upstream",
+		Required: true,
+		Run: func() CheckResult {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeUrl, nil)
+			if err != nil {
+				return CheckResult{Status: StatusFailing, Error: err.Error()}
+			}
+
+			start := time.Now()
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				return CheckResult{Status: StatusFailing, Error: err.Error()}
+			}
+			_ = resp.Body.Close()
+
+			result := CheckResult{
+				Status: StatusOk,
+				Details: map[string]interface{}{
+					"status_code": resp.StatusCode,
+					"duration_ms": time.Since(start).Milliseconds(),
+				},
+			}
+			if resp.StatusCode >= 500 {
+				result.Status = StatusFailing
+				result.Error = fmt.Sprintf("upstream answered with status code %d", resp.StatusCode)
+			}
+			return result
+		},
+	}
+}
@@ -0,0 +1,94 @@
+package mgmt
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadinessWithValidCredentials(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	handler := NewReadinessHandler(CredentialsCheck(proxy.NewCredentials(&testhelper.ReadClient{})))
+	response, status := getReadiness(t, handler)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, StatusOk, response.Status)
+	assert.Equal(t, proxy.CredentialProviderName, response.Checks["credentials"].Details["provider"])
+	assert.InDelta(t, 3600, response.Checks["credentials"].Details["expires_in_seconds"], 5)
+}
+
+func TestReadinessFailsWithoutCredentials(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	handler := NewReadinessHandler(CredentialsCheck(proxy.NewCredentials(&testhelper.ReadClient{Failing: true})))
+	response, status := getReadiness(t, handler)
+
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, StatusUnavailable, response.Status)
+	assert.Equal(t, StatusFailing, response.Checks["credentials"].Status)
+}
+
+func TestReadinessIgnoresOptionalChecks(t *testing.T) {
+
+	breaker := circuitbreaker.NewCircuitBreaker("test")
+	for i := 0; i < 10; i++ {
+		_, _ = breaker.Execute(func() (interface{}, error) {
+			return nil, errors.New("something went wrong")
+		})
+	}
+
+	response, status := getReadiness(t, NewReadinessHandler(CircuitBreakerCheck(breaker)))
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, StatusFailing, response.Checks["circuit_breaker"].Status)
+	assert.Equal(t, "open", response.Checks["circuit_breaker"].Details["state"])
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	handler := NewReadinessHandler(CredentialsCheck(proxy.NewCredentials(&testhelper.ReadClient{})))
+	handler.Drain()
+	response, status := getReadiness(t, handler)
+
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, StatusDraining, response.Status)
+}
+
+func TestReadinessProbesUpstream(t *testing.T) {
+
+	upstreamStatus := http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(upstreamStatus)
+	}))
+	defer upstream.Close()
+
+	handler := NewReadinessHandler(UpstreamCheck(http.DefaultTransport, upstream.URL+"/_cluster/health", time.Second))
+
+	_, status := getReadiness(t, handler)
+	assert.Equal(t, http.StatusOK, status)
+
+	upstreamStatus = http.StatusBadGateway
+	response, status := getReadiness(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, float64(http.StatusBadGateway), response.Checks["upstream"].Details["status_code"])
+}
+
+func getReadiness(t *testing.T, handler http.Handler) (ReadinessResponse, int) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status/ready", nil))
+
+	var response ReadinessResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	return response, rec.Code
+}
+
+// withoutEnvironmentCredentials makes sure the credentials chain does not pick up credentials of the machine running the tests
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 type RestClient struct {
@@ -63,8 +66,20 @@ type AuthServerResponse struct {
 	ExpiresIn int    `json:"expires_in"`
 }
 
+// authServerResponse additionally accepts the standard OAuth2 "id_token" field and, as providers often
+// answer the client credentials grant without id token, the access token if it is a JWT as well
+type authServerResponse struct {
+	AuthServerResponse
+	StandardIdToken string `json:"id_token"`
+	AccessToken     string `json:"access_token"`
+}
+
 func (p *PostRequest) Do() (*AuthServerResponse, error) {
-	authServerUrl := p.httpClient.baseUrl
+	return p.DoWithUrl(p.httpClient.baseUrl)
+}
+
+// DoWithUrl sends the client credentials as JSON body, which is what the in-house auth server expects
+func (p *PostRequest) DoWithUrl(authServerUrl string) (*AuthServerResponse, error) {
 	body, err := json.MarshalIndent(p.body, "", "")
 	if err != nil {
 		return nil, err
@@ -77,15 +92,99 @@ func (p *PostRequest) Do() (*AuthServerResponse, error) {
 	for name, value := range p.header {
 		req.Header.Add(name, value[0])
 	}
+	return p.send(req)
+}
+
+// DoClientCredentials sends a standard OAuth2 client credentials request (RFC 6749, section 4.4) to the token endpoint.
+// The client authenticates with HTTP Basic auth unless the endpoint only supports the credentials in the form.
+func (p *PostRequest) DoClientCredentials(tokenEndpoint string, clientSecretPost bool) (*AuthServerResponse, error) {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"scope":      {"openid"},
+	}
+	if clientSecretPost {
+		form.Set("client_id", p.body.Identity)
+		form.Set("client_secret", p.body.Secret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !clientSecretPost {
+		// the credentials are form encoded before they are put into the header, see RFC 6749, section 2.3.1
+		req.SetBasicAuth(url.QueryEscape(p.body.Identity), url.QueryEscape(p.body.Secret))
+	}
+	return p.send(req)
+}
+
+func (p *PostRequest) send(req *http.Request) (*AuthServerResponse, error) {
 	r, err := p.httpClient.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer r.Body.Close()
+	if r.StatusCode > 299 {
+		return nil, circuitbreaker.NewStatusError(r.StatusCode, fmt.Sprintf("encountered error while connecting to auth server '%s'. status-code: %d", req.URL, r.StatusCode))
+	}
+
+	var response authServerResponse
+	err = json.NewDecoder(r.Body).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	if response.IdToken == "" {
+		response.IdToken = response.StandardIdToken
+	}
+	if response.IdToken == "" {
+		response.IdToken = response.AccessToken
+	}
+	return &response.AuthServerResponse, nil
+}
+
+type DiscoveryDocument struct {
+	Issuer                   string   `json:"issuer"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JwksUri                  string   `json:"jwks_uri"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// ClientSecretPost tells whether the token endpoint expects the client credentials in the form instead of Basic auth.
+// Without auth methods, the token endpoint supports Basic auth as the default of the specification.
+func (d *DiscoveryDocument) ClientSecretPost() bool {
+	for _, method := range d.TokenEndpointAuthMethods {
+		if method == "client_secret_basic" {
+			return false
+		}
+	}
+	for _, method := range d.TokenEndpointAuthMethods {
+		if method == "client_secret_post" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *RestClient) Discover(issuerUrl string) (*DiscoveryDocument, error) {
+	discoveryUrl := strings.TrimSuffix(issuerUrl, "/") + "/.well-known/openid-configuration"
+	r, err := h.client.Get(discoveryUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
 	if r.StatusCode > 299 {
-		return nil, fmt.Errorf("encountered error while connecting to auth server '%s'. status-code: %d", authServerUrl, r.StatusCode)
+		return nil, fmt.Errorf("encountered error while fetching discovery document '%s'. status-code: %d", discoveryUrl, r.StatusCode)
 	}
 
-	var authServerResponse AuthServerResponse
-	err = json.NewDecoder(r.Body).Decode(&authServerResponse)
-	return &authServerResponse, nil
+	var document DiscoveryDocument
+	err = json.NewDecoder(r.Body).Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	if document.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery document '%s' does not contain a token_endpoint", discoveryUrl)
+	}
+	return &document, nil
 }
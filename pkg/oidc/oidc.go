@@ -1,6 +1,8 @@
 package oidc
 
 import (
+	"context"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -10,12 +12,15 @@ import (
 	. "github.com/idealo/aws-signing-proxy/pkg/logging"
 	"github.com/idealo/aws-signing-proxy/pkg/oidc/internal"
 	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/idealo/aws-signing-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"net/http"
+	"sync"
 	"time"
 )
 
-var cachedCredentials *sts.Credentials
+const tracerName = "github.com/idealo/aws-signing-proxy/pkg/oidc"
 
 type ReadClient struct {
 	restClient    *internal.RestClient
@@ -23,14 +28,25 @@ type ReadClient struct {
 	postRequest   *internal.PostRequest
 	stsClient     stsiface.STSAPI
 	authServerUrl string
+	issuerUrl     string
 	clientId      string
 	clientSecret  string
 	roleArn       string
+
+	discoveryMutex sync.RWMutex
+	discovery      *internal.DiscoveryDocument
+
+	mutex             sync.Mutex
+	cachedCredentials *sts.Credentials
+	breaker           *circuitbreaker.CircuitBreaker
 }
 
-func NewOIDCClient(region string) *ReadClient {
+// NewOIDCClient creates a client which exchanges the token of the auth server for credentials at STS.
+// The configs customize the STS client, e.g. its http.Client.
+func NewOIDCClient(region string, configs ...*aws.Config) *ReadClient {
 	return &ReadClient{
-		stsClient: InitClient(region),
+		stsClient: InitClient(region, configs...),
+		breaker:   circuitbreaker.NewCircuitBreaker("oidc"),
 	}
 }
 
@@ -44,6 +60,13 @@ func (c *ReadClient) WithAuthServerUrl(authServerUrl string) *ReadClient {
 	return c
 }
 
+// WithIssuerUrl enables OpenID Connect discovery: the token endpoint is looked up in the
+// issuer's /.well-known/openid-configuration instead of using a fixed auth server url.
+func (c *ReadClient) WithIssuerUrl(issuerUrl string) *ReadClient {
+	c.issuerUrl = issuerUrl
+	return c
+}
+
 func (c *ReadClient) WithClientSecret(clientSecret string) *ReadClient {
 	c.clientSecret = clientSecret
 	return c
@@ -59,23 +82,35 @@ func (c *ReadClient) WithRoleArn(roleArn string) *ReadClient {
 	return c
 }
 
+// WithCircuitBreakerSettings replaces the circuit breaker guarding the auth server with one using the given settings
+func (c *ReadClient) WithCircuitBreakerSettings(settings circuitbreaker.Settings) *ReadClient {
+	c.breaker = circuitbreaker.NewCircuitBreakerWithSettings("oidc", settings)
+	return c
+}
+
 func (c *ReadClient) Build() *ReadClient {
 	if c.httpClient == nil {
 		c.httpClient = http.DefaultClient
 	}
-	postRequest := internal.NewRestClient().
+	c.restClient = internal.NewRestClient().
 		WithBaseUrl(c.authServerUrl).
-		WithHttpClient(c.httpClient).
+		WithHttpClient(c.httpClient)
+
+	postRequest := c.restClient.
 		Post().
 		WithClientCredentials(c.clientId, c.clientSecret).
 		WithHeader("Content-Type", []string{"application/json"})
 
 	c.postRequest = postRequest
 
+	if c.breaker == nil {
+		c.breaker = circuitbreaker.NewCircuitBreaker("oidc")
+	}
+
 	return c
 }
 
-func (c *ReadClient) retrieveShortLivingCredentialsFromAwsSts(roleArn string, webToken string, roleSessionName string) *sts.Credentials {
+func (c *ReadClient) retrieveShortLivingCredentialsFromAwsSts(roleArn string, webToken string, roleSessionName string) (*sts.Credentials, error) {
 	identity, err := c.stsClient.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
 		RoleArn:          &roleArn,
 		RoleSessionName:  &roleSessionName,
@@ -84,28 +119,37 @@ func (c *ReadClient) retrieveShortLivingCredentialsFromAwsSts(roleArn string, we
 
 	if err != nil {
 		Logger.Error("Something went wrong with the STS Client", zap.Error(err))
+		return nil, err
+	}
+	if identity.Credentials == nil {
+		return nil, errors.New("AWS STS did not return any credentials")
 	}
 
-	return identity.Credentials
+	return identity.Credentials, nil
 }
 
-func InitClient(region string) stsiface.STSAPI {
+// InitClient creates an anonymous STS client, the configs are merged in order
+func InitClient(region string, configs ...*aws.Config) stsiface.STSAPI {
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region:      aws.String(region),
 		Credentials: credentials.AnonymousCredentials},
 	))
 
-	return sts.New(sess, aws.NewConfig().WithRegion(region))
+	return sts.New(sess, append([]*aws.Config{aws.NewConfig().WithRegion(region)}, configs...)...)
 }
 
 func (c *ReadClient) RefreshCredentials(result interface{}) error {
+	return c.RefreshCredentialsWithContext(context.Background(), result)
+}
+
+// RefreshCredentialsWithContext traces fetching new credentials as part of the request in the context
+func (c *ReadClient) RefreshCredentialsWithContext(ctx context.Context, result interface{}) error {
 	refreshedCredentials := result.(*proxy.RefreshedCredentials)
 
-	err := RetrieveCredentials(c)
+	stsCredentials, err := c.credentials(ctx)
 	if err != nil {
 		return err
 	}
-	stsCredentials := cachedCredentials
 
 	refreshedCredentials.ExpiresAt = *stsCredentials.Expiration
 	refreshedCredentials.Data.AccessKey = *stsCredentials.AccessKeyId
@@ -115,26 +159,131 @@ func (c *ReadClient) RefreshCredentials(result interface{}) error {
 	return nil
 }
 
-var breaker = circuitbreaker.NewCircuitBreaker()
+// ExpireCredentials drops the cached credentials, so the next refresh fetches new ones
+func (c *ReadClient) ExpireCredentials() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cachedCredentials = nil
+}
+
+func (c *ReadClient) Name() string {
+	return "oidc"
+}
 
 func RetrieveCredentials(c *ReadClient) error {
-	if cachedCredentials == nil || isExpired(cachedCredentials.Expiration) {
+	_, err := c.credentials(context.Background())
+	return err
+}
 
-		response, err := breaker.Execute(func() (interface{}, error) {
-			return c.postRequest.Do()
-		})
+// credentials returns the cached credentials of this client and refreshes them ahead of their expiry.
+// Concurrent callers wait for a single refresh instead of hitting the auth server and AWS STS in parallel.
+func (c *ReadClient) credentials(ctx context.Context) (*sts.Credentials, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
+	if c.cachedCredentials == nil || isExpired(c.cachedCredentials.Expiration) {
+
+		start := time.Now()
+		stsCredentials, err := c.fetchCredentials(ctx)
+		proxy.ObserveRefresh(c.Name(), start, err)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		c.cachedCredentials = stsCredentials
+		Logger.Info("Refreshed short living credentials.", zap.String("role-arn", c.roleArn))
+	}
+	return c.cachedCredentials, nil
+}
 
-		cachedCredentials = c.retrieveShortLivingCredentialsFromAwsSts(c.roleArn, response.(*internal.AuthServerResponse).IdToken, c.clientId)
-		Logger.Info("Refreshed short living credentials.")
+// fetchCredentials retrieves an id token from the auth server and exchanges it for new short living credentials
+func (c *ReadClient) fetchCredentials(ctx context.Context) (*sts.Credentials, error) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "oidc.token")
+	response, err := c.breaker.Execute(func() (interface{}, error) {
+		return c.requestToken()
+	})
+	tracing.End(span, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	idToken := response.(*internal.AuthServerResponse).IdToken
+	err = validateIdToken(idToken, c.expectedIssuer(), time.Now())
+	if err != nil {
+		return nil, err
 	}
+
+	_, span = otel.Tracer(tracerName).Start(ctx, "sts.AssumeRoleWithWebIdentity")
+	stsCredentials, err := c.retrieveShortLivingCredentialsFromAwsSts(c.roleArn, idToken, c.clientId)
+	tracing.End(span, err)
+	return stsCredentials, err
+}
+
+// RefreshDiscovery fetches the discovery document of the configured issuer and replaces the cached one.
+// On failure the previously cached document stays in use.
+func (c *ReadClient) RefreshDiscovery() error {
+	if c.issuerUrl == "" {
+		return nil
+	}
+
+	document, err := c.restClient.Discover(c.issuerUrl)
+	if err != nil {
+		return err
+	}
+
+	c.discoveryMutex.Lock()
+	defer c.discoveryMutex.Unlock()
+	c.discovery = document
+	Logger.Debug("Refreshed OpenID Connect discovery document.", zap.String("token-endpoint", document.TokenEndpoint))
 	return nil
 }
 
+// requestToken asks the in-house auth server for a token. With discovery, a standard client credentials
+// request is sent to the discovered token endpoint instead.
+func (c *ReadClient) requestToken() (*internal.AuthServerResponse, error) {
+	if c.issuerUrl == "" {
+		return c.postRequest.DoWithUrl(c.authServerUrl)
+	}
+
+	document, err := c.discoveryDocument()
+	if err != nil {
+		return nil, err
+	}
+	return c.postRequest.DoClientCredentials(document.TokenEndpoint, document.ClientSecretPost())
+}
+
+// discoveryDocument returns the cached discovery document and fetches it if there is none yet
+func (c *ReadClient) discoveryDocument() (*internal.DiscoveryDocument, error) {
+	c.discoveryMutex.RLock()
+	document := c.discovery
+	c.discoveryMutex.RUnlock()
+
+	if document == nil {
+		if err := c.RefreshDiscovery(); err != nil {
+			return nil, err
+		}
+		c.discoveryMutex.RLock()
+		document = c.discovery
+		c.discoveryMutex.RUnlock()
+	}
+	return document, nil
+}
+
+func (c *ReadClient) expectedIssuer() string {
+	c.discoveryMutex.RLock()
+	defer c.discoveryMutex.RUnlock()
+
+	if c.discovery != nil && c.discovery.Issuer != "" {
+		return c.discovery.Issuer
+	}
+	return c.issuerUrl
+}
+
 func isExpired(expiration *time.Time) bool {
 	// subtract 5 minutes from the actual expiration to retrieve every 55 minutes new credentials
 	return time.Now().After(expiration.Add(-time.Minute * 5))
 }
+
+func (c *ReadClient) CircuitBreaker() *circuitbreaker.CircuitBreaker {
+	return c.breaker
+}
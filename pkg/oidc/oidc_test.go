@@ -1,12 +1,18 @@
 package oidc
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -20,7 +26,7 @@ func TestRetrieveCredentialsAheadOfTime(t *testing.T) {
 
 	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		response := MockOauthServerResponse{
-			IdToken:   "shortLivedIdToken",
+			IdToken:   newIdToken("", time.Now().Add(time.Hour)),
 			ExpiresIn: 3599,
 		}
 		bytes, _ := json.Marshal(response)
@@ -56,9 +62,9 @@ func TestRetrieveCredentialsAheadOfTime(t *testing.T) {
 		SessionToken:    &sessionToken,
 	}
 
-	got := cachedCredentials
+	got := readClient.cachedCredentials
 
-	if !reflect.DeepEqual(cachedCredentials, want) {
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("RetrieveCredentials() = %v, want %v", got, want)
 	}
 
@@ -82,9 +88,9 @@ func TestRetrieveShortLivingCredentials(t *testing.T) {
 		SecretAccessKey: &secretAccessKey,
 		SessionToken:    &sessionToken,
 	}
-	got := client.retrieveShortLivingCredentialsFromAwsSts("foo", "bar", "session")
+	got, err := client.retrieveShortLivingCredentialsFromAwsSts("foo", "bar", "session")
 
-	if !reflect.DeepEqual(got, want) {
+	if err != nil || !reflect.DeepEqual(got, want) {
 		t.Errorf("retrieveShortLivingCredentialsFromAwsSts() = %v, want %v", got, want)
 	}
 }
@@ -109,3 +115,249 @@ func (*mockStsClient) AssumeRoleWithWebIdentity(*sts.AssumeRoleWithWebIdentityIn
 		},
 	}, nil
 }
+
+func TestRetrieveCredentialsViaDiscovery(t *testing.T) {
+
+	var issuer string
+	var tokenRequests int
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_, _ = fmt.Fprintf(w, `{"issuer":"%s","token_endpoint":"%s/oauth2/token"}`, issuer, issuer)
+		case "/oauth2/token":
+			tokenRequests++
+			if id, secret, ok := r.BasicAuth(); !ok || id != "client_id" || secret != "client_secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"id_token":"%s"}`, newIdToken(issuer, time.Now().Add(time.Hour)))
+		default:
+			http.NotFoundHandler().ServeHTTP(w, r)
+		}
+	}))
+	defer mockServer.Close()
+	issuer = mockServer.URL
+
+	client := &ReadClient{
+		stsClient:    &mockStsClient{},
+		issuerUrl:    mockServer.URL,
+		clientId:     "client_id",
+		clientSecret: "client_secret",
+		roleArn:      "role_arn",
+	}
+	client.Build()
+
+	if err := RetrieveCredentials(client); err != nil {
+		t.Fatal(err)
+	}
+
+	if tokenRequests != 1 {
+		t.Errorf("expected the discovered token endpoint to be called once, got %d", tokenRequests)
+	}
+	if client.cachedCredentials == nil || *client.cachedCredentials.AccessKeyId != "accessKeyId" {
+		t.Errorf("RetrieveCredentials() did not cache the STS credentials")
+	}
+}
+
+func TestClientCredentialsRequestToDiscoveredTokenEndpoint(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		authMethods string
+		wantForm    url.Values
+		wantBasic   bool
+	}{
+		{
+			name:        "client_secret_basic by default",
+			authMethods: `[]`,
+			wantForm:    url.Values{"grant_type": {"client_credentials"}, "scope": {"openid"}},
+			wantBasic:   true,
+		},
+		{
+			name:        "client_secret_post if it is the only method",
+			authMethods: `["client_secret_post"]`,
+			wantForm:    url.Values{"grant_type": {"client_credentials"}, "scope": {"openid"}, "client_id": {"client:id"}, "client_secret": {"se&cret"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var issuer string
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/.well-known/openid-configuration" {
+					_, _ = fmt.Fprintf(w, `{"issuer":"%s","token_endpoint":"%s/token","token_endpoint_auth_methods_supported":%s}`, issuer, issuer, tt.authMethods)
+					return
+				}
+
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+					t.Errorf("got %s with Content-Type %q, want a form post", r.Method, r.Header.Get("Content-Type"))
+				}
+				if err := r.ParseForm(); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(r.PostForm, tt.wantForm) {
+					t.Errorf("form = %v, want %v", r.PostForm, tt.wantForm)
+				}
+				id, secret, ok := r.BasicAuth()
+				if ok != tt.wantBasic {
+					t.Errorf("Basic auth = %v, want %v", ok, tt.wantBasic)
+				}
+				if tt.wantBasic && (id != "client%3Aid" || secret != "se%26cret") {
+					t.Errorf("Basic auth = %s:%s, want form encoded credentials", id, secret)
+				}
+				// a standard token response without id token
+				_, _ = fmt.Fprintf(w, `{"access_token":"%s","token_type":"Bearer","expires_in":3600}`, newIdToken(issuer, time.Now().Add(time.Hour)))
+			}))
+			defer mockServer.Close()
+			issuer = mockServer.URL
+
+			client := (&ReadClient{
+				stsClient:    &mockStsClient{},
+				issuerUrl:    mockServer.URL,
+				clientId:     "client:id",
+				clientSecret: "se&cret",
+				roleArn:      "role_arn",
+			}).Build()
+
+			if err := RetrieveCredentials(client); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRefreshDiscoveryKeepsCachedDocumentOnFailure(t *testing.T) {
+
+	available := true
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"issuer":"https://issuer.invalid","token_endpoint":"https://issuer.invalid/token"}`))
+	}))
+	defer mockServer.Close()
+
+	client := (&ReadClient{issuerUrl: mockServer.URL}).Build()
+
+	if err := client.RefreshDiscovery(); err != nil {
+		t.Fatal(err)
+	}
+
+	available = false
+	if err := client.RefreshDiscovery(); err == nil {
+		t.Error("expected RefreshDiscovery() to fail")
+	}
+
+	document, err := client.discoveryDocument()
+	if err != nil || document.TokenEndpoint != "https://issuer.invalid/token" {
+		t.Errorf("discoveryDocument() = %v, %v, want cached document", document, err)
+	}
+}
+
+func TestValidateIdToken(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		name    string
+		token   string
+		issuer  string
+		wantErr string
+	}{
+		{"valid", newIdToken("https://issuer.invalid", now.Add(time.Minute)), "https://issuer.invalid", ""},
+		{"issuer not checked without discovery", newIdToken("https://other.invalid", now.Add(time.Minute)), "", ""},
+		{"wrong issuer", newIdToken("https://other.invalid", now.Add(time.Minute)), "https://issuer.invalid", "expected 'https://issuer.invalid'"},
+		{"expired", newIdToken("https://issuer.invalid", now.Add(-time.Minute)), "https://issuer.invalid", "expired"},
+		{"missing exp", newIdToken("https://issuer.invalid", time.Time{}), "https://issuer.invalid", "exp claim"},
+		{"not a jwt", "shortLivedIdToken", "", "not a valid JWT"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateIdToken(tc.token, tc.issuer, now)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateIdToken() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validateIdToken() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConcurrentClientsKeepSeparateCredentials(t *testing.T) {
+
+	var tokenRequests int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		_, _ = fmt.Fprintf(w, `{"idToken":"%s"}`, newIdToken("", time.Now().Add(time.Hour)))
+	}))
+	defer mockServer.Close()
+
+	roles := []string{"role-a", "role-b", "role-c"}
+	clients := make([]*ReadClient, len(roles))
+	for i, role := range roles {
+		clients[i] = (&ReadClient{
+			stsClient:     &roleAwareStsClient{},
+			authServerUrl: mockServer.URL,
+			roleArn:       role,
+		}).Build()
+	}
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		for j := 0; j < 20; j++ {
+			wg.Add(1)
+			go func(client *ReadClient) {
+				defer wg.Done()
+				if err := RetrieveCredentials(client); err != nil {
+					t.Error(err)
+				}
+			}(clients[i])
+		}
+	}
+	wg.Wait()
+
+	for i, client := range clients {
+		if got := *client.cachedCredentials.AccessKeyId; got != roles[i] {
+			t.Errorf("client for %s got credentials of %s", roles[i], got)
+		}
+	}
+	if tokenRequests != int32(len(roles)) {
+		t.Errorf("expected one auth server request per client, got %d", tokenRequests)
+	}
+}
+
+func newIdToken(issuer string, expiresAt time.Time) string {
+	claims := map[string]interface{}{"sub": "client_id"}
+	if issuer != "" {
+		claims["iss"] = issuer
+	}
+	if !expiresAt.IsZero() {
+		claims["exp"] = expiresAt.Unix()
+	}
+	payload, _ := json.Marshal(claims)
+
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"RS256"}`)) + "." + encode(payload) + "." + encode([]byte("signature"))
+}
+
+// roleAwareStsClient returns credentials whose access key id is the assumed role
+type roleAwareStsClient struct {
+	stsiface.STSAPI
+}
+
+func (*roleAwareStsClient) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	expiration := time.Now().Add(time.Hour)
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     input.RoleArn,
+			Expiration:      &expiration,
+			SecretAccessKey: input.RoleArn,
+			SessionToken:    input.RoleArn,
+		},
+	}, nil
+}
@@ -0,0 +1,55 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// validateIdToken checks the iss and exp claims of the id token before it is exchanged at AWS STS.
+// The signature is not verified here, STS does that when assuming the role.
+func validateIdToken(idToken string, issuer string, now time.Time) error {
+	claims, err := parseIdTokenClaims(idToken)
+	if err != nil {
+		return err
+	}
+
+	if issuer != "" && strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return fmt.Errorf("id token was issued by '%s', expected '%s'", claims.Issuer, issuer)
+	}
+
+	if claims.ExpiresAt == 0 {
+		return errors.New("id token does not contain an exp claim")
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return fmt.Errorf("id token expired at %s", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func parseIdTokenClaims(idToken string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a valid JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("id token payload is not base64url encoded: %w", err)
+	}
+
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("id token payload is not valid JSON: %w", err)
+	}
+	return &claims, nil
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const accessKeyIdPrefixLength = 8
+
+type requestInfoContextKey struct{}
+
+// requestInfo collects details of a proxied request which are only known to the transports, e.g. the identity used for signing
+type requestInfo struct {
+	mutex       sync.Mutex
+	accessKeyId string
+	target      string
+}
+
+func (i *requestInfo) signedBy(accessKeyId string, target string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.accessKeyId = accessKeyId
+	i.target = target
+}
+
+func (i *requestInfo) get() (string, string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.accessKeyId, i.target
+}
+
+func requestInfoFromContext(ctx context.Context) (*requestInfo, bool) {
+	info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return info, ok
+}
+
+// accessLogFiles are shared by the access logs writing to the same file, e.g. by the configuration replaced on reload
+// while it drains and its successor, so there is only a single writer rotating the file
+var (
+	accessLogFilesMutex sync.Mutex
+	accessLogFiles      = map[string]*accessLogFile{}
+)
+
+type accessLogFile struct {
+	mutex  sync.Mutex
+	logger *lumberjack.Logger
+	users  int
+}
+
+// openAccessLogFile returns the file shared by all access logs writing to logger.Filename. Its rotation settings are
+// replaced by the ones of logger, so the last opened access log decides them.
+func openAccessLogFile(logger *lumberjack.Logger) *accessLogFile {
+	accessLogFilesMutex.Lock()
+	defer accessLogFilesMutex.Unlock()
+
+	file, ok := accessLogFiles[logger.Filename]
+	if !ok {
+		file = &accessLogFile{logger: logger}
+		accessLogFiles[logger.Filename] = file
+	}
+	file.users++
+
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	current := file.logger
+	if current.MaxSize != logger.MaxSize || current.MaxBackups != logger.MaxBackups || current.MaxAge != logger.MaxAge {
+		// the file is opened again by the next write
+		_ = current.Close()
+		file.logger = logger
+	}
+	return file
+}
+
+func (f *accessLogFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.logger.Write(p)
+}
+
+// release closes the file once its last access log is closed
+func (f *accessLogFile) release() error {
+	accessLogFilesMutex.Lock()
+	defer accessLogFilesMutex.Unlock()
+
+	f.users--
+	if f.users > 0 {
+		return nil
+	}
+	delete(accessLogFiles, f.logger.Filename)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.logger.Close()
+}
+
+// AccessLog writes a line for every proxied request, either through the Logger or to a separate file with rotation
+type AccessLog struct {
+	logger         *zap.Logger
+	file           *accessLogFile
+	sampleRate     float64
+	excludePaths   *Routes
+	trustedProxies []*net.IPNet
+}
+
+// NewAccessLog logs through the Logger
+func NewAccessLog() *AccessLog {
+	return &AccessLog{
+		logger:       Logger.Named("access"),
+		sampleRate:   1,
+		excludePaths: NewRoutes(nil),
+	}
+}
+
+// WithFile writes the access log to the file instead, which is rotated once it reaches maxSizeMb.
+// Access logs writing to the same file share it until they are closed.
+func (a *AccessLog) WithFile(file string, maxSizeMb int, maxBackups int, maxAgeDays int) *AccessLog {
+	a.file = openAccessLogFile(&lumberjack.Logger{
+		Filename:   file,
+		MaxSize:    maxSizeMb,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAgeDays,
+	})
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
+	a.logger = zap.New(Redact(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(a.file), zapcore.InfoLevel)))
+	return a
+}
+
+// Close releases the access log file, if the access log is written to one. The file is closed once no other access log writes to it.
+func (a *AccessLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	file := a.file
+	a.file = nil
+	return file.release()
+}
+
+// WithSampleRate sets the share of successful requests which are logged. Failed requests are always logged.
+func (a *AccessLog) WithSampleRate(sampleRate float64) *AccessLog {
+	a.sampleRate = sampleRate
+	return a
+}
+
+// WithExcludePaths sets route templates which are not logged, e.g. health checks
+func (a *AccessLog) WithExcludePaths(excludePaths []string) *AccessLog {
+	a.excludePaths = NewRoutes(excludePaths)
+	return a
+}
+
+// WithTrustedProxies sets the networks of the load balancers in front of the proxy, whose X-Forwarded-For header is used for the client IP
+func (a *AccessLog) WithTrustedProxies(trustedProxies []*net.IPNet) *AccessLog {
+	a.trustedProxies = trustedProxies
+	return a
+}
+
+// Handler logs every request served by next
+func (a *AccessLog) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.excludePaths.Matches(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		info := &requestInfo{}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoContextKey{}, info))
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		rw := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rw, req)
+
+		status := rw.statusCode()
+		if status < 400 && !a.sampled() {
+			return
+		}
+
+		accessKeyId, target := info.get()
+		a.logger.Info("Proxied request",
+			zap.String("method", req.Method),
+			zap.String("path", req.URL.Path),
+			zap.Int("status", status),
+			zap.Duration("duration", time.Since(start)),
+			zap.Int64("bytes-in", body.bytes),
+			zap.Int64("bytes-out", rw.bytes),
+			zap.String("client-ip", clientIp(req, a.trustedProxies)),
+			zap.String("identity", RedactAccessKeyId(accessKeyId)),
+			zap.String("target", target),
+			zap.String("aws-request-id", awsRequestId(rw.Header())),
+			zap.String("aws-error-code", rw.awsErrorCode),
+		)
+	})
+}
+
+func (a *AccessLog) sampled() bool {
+	return a.sampleRate >= 1 || rand.Float64() < a.sampleRate
+}
+
+// clientIp returns the address of the connection. X-Forwarded-For can be set by anyone, so it is only used if the connection
+// comes from a trusted proxy. Its addresses are read from the right, the first one which is no trusted proxy is the client.
+func clientIp(req *http.Request, trustedProxies []*net.IPNet) string {
+	ip := remoteHost(req.RemoteAddr)
+	if !inNetworks(ip, trustedProxies) {
+		return ip
+	}
+
+	forwardedFor := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwardedFor[i])
+		if address == "" {
+			continue
+		}
+		ip = address
+		if !inNetworks(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// awsRequestId reads the request id AWS services answer with, x-amz-request-id is used by S3
+func awsRequestId(header http.Header) string {
+	if requestId := header.Get("X-Amzn-Requestid"); requestId != "" {
+		return requestId
+	}
+	return header.Get("X-Amz-Request-Id")
+}
+
+// RedactAccessKeyId keeps only the prefix of an access key id, which is enough to tell identities apart
+func RedactAccessKeyId(accessKeyId string) string {
+	if len(accessKeyId) <= accessKeyIdPrefixLength {
+		return accessKeyId
+	}
+	return accessKeyId[:accessKeyIdPrefixLength] + "..."
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amzn-RequestId", "4711")
+		if r.URL.Path == "/missing" {
+			w.Header().Set("x-amzn-ErrorType", "ResourceNotFoundException:http://internal.amazon.com/")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	core, logs := observer.New(zap.InfoLevel)
+	accessLog := NewAccessLog().WithExcludePaths([]string{"/_cluster/health"})
+	accessLog.logger = zap.New(core)
+
+	target, _ := url.Parse(upstream.URL)
+	handler := accessLog.Handler(NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{ExpiresIn: time.Hour},
+	}))
+	serve := func(method string, path string, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(http.MethodPost, "/logs/_search", `{"query":{}}`)
+	serve(http.MethodGet, "/missing", "")
+	serve(http.MethodGet, "/_cluster/health", "")
+
+	entries := logs.AllUntimed()
+	assert.Len(t, entries, 2)
+
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "POST", fields["method"])
+	assert.Equal(t, "/logs/_search", fields["path"])
+	assert.Equal(t, int64(200), fields["status"])
+	assert.Equal(t, int64(12), fields["bytes-in"])
+	assert.Equal(t, int64(5), fields["bytes-out"])
+	// X-Forwarded-For is ignored without trusted proxies
+	assert.Equal(t, "192.0.2.1", fields["client-ip"])
+	assert.Equal(t, "accessKe...", fields["identity"])
+	assert.Equal(t, target.Host, fields["target"])
+	assert.Equal(t, "4711", fields["aws-request-id"])
+
+	fields = entries[1].ContextMap()
+	assert.Equal(t, int64(404), fields["status"])
+	assert.Equal(t, "ResourceNotFoundException", fields["aws-error-code"])
+}
+
+func TestClientIp(t *testing.T) {
+	_, loadBalancers, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{loadBalancers}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"without X-Forwarded-For", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"from an untrusted client", "192.0.2.1:1234", []string{"203.0.113.7"}, "192.0.2.1"},
+		{"from a trusted proxy", "10.0.0.2:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"with an address spoofed by the client", "10.0.0.2:1234", []string{"198.51.100.1, 203.0.113.7, 10.0.0.3"}, "203.0.113.7"},
+		{"in several headers", "10.0.0.2:1234", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"only through trusted proxies", "10.0.0.2:1234", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, forwardedFor := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			assert.Equal(t, tt.want, clientIp(req, trustedProxies))
+		})
+	}
+}
+
+func TestAccessLogSamplesOnlySuccessfulRequests(t *testing.T) {
+
+	core, logs := observer.New(zap.InfoLevel)
+	accessLog := NewAccessLog().WithSampleRate(0)
+	accessLog.logger = zap.New(core)
+
+	status := http.StatusOK
+	handler := accessLog.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, 0, logs.Len())
+
+	status = http.StatusBadGateway
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, 1, logs.Len())
+}
+
+func TestAccessLogsShareTheirFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	previous := NewAccessLog().WithFile(path, 100, 5, 7)
+	next := NewAccessLog().WithFile(path, 100, 5, 7)
+	assert.Same(t, previous.file, next.file, "a single writer rotates the file")
+
+	previous.Handler(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/previous", nil))
+	assert.NoError(t, previous.Close())
+	next.Handler(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/next", nil))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(content), "\n"))
+	assert.Contains(t, string(content), `"path":"/previous"`)
+	assert.Contains(t, string(content), `"path":"/next"`)
+
+	assert.NoError(t, next.Close())
+	assert.NotContains(t, accessLogFiles, path, "the file is closed with its last access log")
+}
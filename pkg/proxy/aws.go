@@ -1,50 +1,198 @@
 package proxy
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.uber.org/zap"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// CredentialProviderName is the provider name of credentials fetched through a ReadClient
+const CredentialProviderName = "CredentialProvider"
+
+// ErrCredentialsUnavailable is returned when credentials could not be refreshed and no
+// previously fetched credentials are valid anymore. The proxy answers with 503 in that case.
+var ErrCredentialsUnavailable = errors.New("no valid AWS credentials available")
+
+var credentialsFetchDeduplicatedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "credentials_fetch_deduplicated_total",
+	Help: "Number of requests for credentials which waited for an already running fetch instead of fetching them",
+})
+
 type ReadClient interface {
 	RefreshCredentials(result interface{}) error
 }
 
-func NewCredChain(rc ReadClient) *credentials.Credentials {
+// ContextReadClient is implemented by ReadClients which trace fetching credentials as part of the request they are fetched for
+type ContextReadClient interface {
+	ReadClient
+	RefreshCredentialsWithContext(ctx context.Context, result interface{}) error
+}
+
+// NamedReadClient is implemented by ReadClients which tell the name of their credentials provider, e.g. vault
+type NamedReadClient interface {
+	ReadClient
+	Name() string
+}
+
+// CachingReadClient is implemented by ReadClients which cache credentials on their own
+type CachingReadClient interface {
+	ReadClient
+	// ExpireCredentials drops the cached credentials, so the next refresh fetches new ones
+	ExpireCredentials()
+}
+
+// Credentials is the credentials chain used for signing along with the provider of
+// short-lived credentials, which is nil if only static credentials are used.
+type Credentials struct {
+	*credentials.Credentials
+	Provider *CredentialProvider
+	chain    *chainProvider
+}
+
+func NewCredentials(rc ReadClient) *Credentials {
 	providers := []credentials.Provider{
 		&credentials.EnvProvider{},                                        // query environment AWS_ACCESS_ID etc.
 		&credentials.SharedCredentialsProvider{Filename: "", Profile: ""}, // use ~/.aws/credentials
 	}
+	var provider *CredentialProvider
 	if rc != nil {
-		providers = append(providers, NewCredentialProvider(rc))
+		provider = NewCredentialProvider(rc)
+		providers = append(providers, provider)
+	}
+
+	chain := &chainProvider{providers: providers}
+	return &Credentials{
+		Credentials: credentials.NewCredentials(chain),
+		Provider:    provider,
+		chain:       chain,
+	}
+}
+
+type retrieveMarkerKey struct{}
+
+// GetWithContext returns the cached credentials or fetches new ones. The credentials let concurrent callers
+// wait for a single fetch, the callers which waited instead of fetching themselves are counted as deduplicated.
+func (c *Credentials) GetWithContext(ctx credentials.Context) (credentials.Value, error) {
+	if c.chain == nil {
+		return c.Credentials.GetWithContext(ctx)
+	}
+
+	// the fetch runs with the context of its first caller, which is marked by the chain
+	retrieved := &atomic.Bool{}
+	before := c.chain.retrievals.Load()
+	value, err := c.Credentials.GetWithContext(context.WithValue(ctx, retrieveMarkerKey{}, retrieved))
+	if !retrieved.Load() && c.chain.retrievals.Load() != before {
+		credentialsFetchDeduplicatedCounter.Inc()
+	}
+	return value, err
+}
+
+// chainProvider works like credentials.ChainProvider, but passes the context on to the providers supporting it
+type chainProvider struct {
+	mutex     sync.Mutex
+	providers []credentials.Provider
+	current   credentials.Provider
+	// retrievals counts the finished retrievals
+	retrievals atomic.Int64
+}
+
+func (c *chainProvider) Retrieve() (credentials.Value, error) {
+	return c.RetrieveWithContext(context.Background())
+}
+
+func (c *chainProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	if retrieved, ok := ctx.Value(retrieveMarkerKey{}).(*atomic.Bool); ok {
+		retrieved.Store(true)
 	}
-	verboseErrors := false
+	defer c.retrievals.Add(1)
+
+	for _, p := range c.providers {
+		var value credentials.Value
+		var err error
+		if contextProvider, ok := p.(credentials.ProviderWithContext); ok {
+			value, err = contextProvider.RetrieveWithContext(ctx)
+		} else {
+			value, err = p.Retrieve()
+		}
+
+		if err == nil {
+			c.mutex.Lock()
+			c.current = p
+			c.mutex.Unlock()
+			return value, nil
+		}
+	}
+
+	c.mutex.Lock()
+	c.current = nil
+	c.mutex.Unlock()
+	return credentials.Value{}, credentials.ErrNoValidProvidersFoundInChain
+}
+
+func (c *chainProvider) IsExpired() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current == nil || c.current.IsExpired()
+}
+
+// Refresh drops all cached credentials and fetches new ones immediately, the chain then takes over the fetched ones.
+// If fetching fails, the last known good credentials stay in use.
+func (c *Credentials) Refresh() (credentials.Value, error) {
+	if c.Provider != nil {
+		if err := c.Provider.refresh(); err != nil {
+			return credentials.Value{}, err
+		}
+	}
+	c.Credentials.Expire()
+	return c.Credentials.Get()
+}
 
-	return credentials.NewCredentials(&credentials.ChainProvider{
-		VerboseErrors: aws.BoolValue(&verboseErrors),
-		Providers:     providers,
-	})
+func NewCredChain(rc ReadClient) *credentials.Credentials {
+	return NewCredentials(rc).Credentials
 }
 
 func NewCredentialProvider(rc ReadClient) *CredentialProvider {
-	return &CredentialProvider{
+	name := "custom"
+	if namedClient, ok := rc.(NamedReadClient); ok {
+		name = namedClient.Name()
+	}
+	provider := &CredentialProvider{
 		client: rc,
+		name:   name,
 	}
+	credentialsRemaining.register(provider)
+	return provider
 }
 
 type CredentialProvider struct {
 	client          ReadClient
+	name            string
+	mutex           sync.RWMutex
 	ExpirationDate  time.Time
 	AccessKey       string
 	SecretAccessKey string
 	SessionToken    string
+	lastKnownGood   *RefreshedCredentials
+	lastRefresh     time.Time
+	// refreshed is set by refresh until the next retrieve hands out the refreshed credentials
+	refreshed bool
 }
 
 type RefreshedCredentials struct {
 	ExpiresAt     time.Time `json:"expires_at"`
+	LeaseId       string    `json:"lease_id"`
 	LeaseDuration int       `json:"lease_duration"`
 	Data          struct {
 		AccessKey     string `json:"access_key"`
@@ -54,31 +202,146 @@ type RefreshedCredentials struct {
 }
 
 func (cp *CredentialProvider) Retrieve() (credentials.Value, error) {
+	return cp.RetrieveWithContext(context.Background())
+}
+
+// RetrieveWithContext fetches new credentials, which is traced as part of the request in the context.
+// Concurrent callers are already collapsed into a single call by the credentials using this provider.
+func (cp *CredentialProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	if refreshed := cp.takeRefreshed(); refreshed != nil {
+		return refreshed.value(), nil
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "credentials.retrieve")
+	span.SetAttributes(attribute.String("credentials.provider", cp.name))
+	defer span.End()
+
 	c := &RefreshedCredentials{}
 
-	err := cp.client.RefreshCredentials(c)
+	err := cp.refreshCredentials(ctx, c)
 
 	if err != nil {
+		span.RecordError(err)
+		// keep signing with the last fetched credentials during an outage as long as they are valid
+		if lastKnownGood := cp.validLastKnownGood(); lastKnownGood != nil {
+			Logger.Warn(
+				"Refreshing credentials failed. Using the last known good credentials.",
+				zap.Time("expires-at", lastKnownGood.ExpiresAt),
+				zap.Error(err),
+			)
+			credentialsFetchesCounter.WithLabelValues(cp.name, "fallback").Inc()
+			span.SetAttributes(attribute.Bool("credentials.fallback", true))
+			return lastKnownGood.value(), nil
+		}
+
+		credentialsFetchesCounter.WithLabelValues(cp.name, "failure").Inc()
+		span.SetStatus(codes.Error, "credentials unavailable")
+
 		if strings.Contains(err.Error(), "circuit breaker is open") {
 			Logger.Warn(
 				"Request to authorization server failed. Circuit breaker is open.",
 			)
-			return credentials.Value{}, nil
 		} else {
 			Logger.Error("An error appeared", zap.Error(err))
-			return credentials.Value{}, err
 		}
+		return credentials.Value{}, fmt.Errorf("%w: %v", ErrCredentialsUnavailable, err)
+	}
+
+	credentialsFetchesCounter.WithLabelValues(cp.name, "success").Inc()
+	credentialsExpiryGauge.WithLabelValues(cp.name).Set(float64(c.ExpiresAt.Unix()))
+
+	cp.mutex.Lock()
+	cp.ExpirationDate = c.ExpiresAt
+	cp.lastKnownGood = c
+	cp.lastRefresh = time.Now()
+	cp.mutex.Unlock()
+
+	return c.value(), nil
+}
+
+// refresh bypasses all caches and fetches new credentials without falling back to the last known good ones
+func (cp *CredentialProvider) refresh() error {
+	if cachingClient, ok := cp.client.(CachingReadClient); ok {
+		cachingClient.ExpireCredentials()
+	}
+
+	c := &RefreshedCredentials{}
+	if err := cp.refreshCredentials(context.Background(), c); err != nil {
+		credentialsFetchesCounter.WithLabelValues(cp.name, "failure").Inc()
+		return fmt.Errorf("%w: %v", ErrCredentialsUnavailable, err)
 	}
+	credentialsFetchesCounter.WithLabelValues(cp.name, "success").Inc()
+	credentialsExpiryGauge.WithLabelValues(cp.name).Set(float64(c.ExpiresAt.Unix()))
 
+	cp.mutex.Lock()
 	cp.ExpirationDate = c.ExpiresAt
+	cp.lastKnownGood = c
+	cp.lastRefresh = time.Now()
+	cp.refreshed = true
+	cp.mutex.Unlock()
+	return nil
+}
+
+// takeRefreshed returns the credentials fetched by refresh once, as long as they are valid
+func (cp *CredentialProvider) takeRefreshed() *RefreshedCredentials {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	refreshed := cp.refreshed
+	cp.refreshed = false
+	if !refreshed || cp.lastKnownGood == nil || !time.Now().Before(cp.lastKnownGood.ExpiresAt) {
+		return nil
+	}
+	return cp.lastKnownGood
+}
+
+func (cp *CredentialProvider) refreshCredentials(ctx context.Context, c *RefreshedCredentials) error {
+	if contextClient, ok := cp.client.(ContextReadClient); ok {
+		return contextClient.RefreshCredentialsWithContext(ctx, c)
+	}
+	return cp.client.RefreshCredentials(c)
+}
+
+func (cp *CredentialProvider) validLastKnownGood() *RefreshedCredentials {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
 
+	if cp.lastKnownGood == nil || !time.Now().Before(cp.lastKnownGood.ExpiresAt) {
+		return nil
+	}
+	return cp.lastKnownGood
+}
+
+func (c *RefreshedCredentials) value() credentials.Value {
 	return credentials.Value{
 		AccessKeyID:     c.Data.AccessKey,
 		SecretAccessKey: c.Data.SecretKey,
 		SessionToken:    c.Data.SecurityToken,
-	}, nil
+		ProviderName:    CredentialProviderName,
+	}
+}
+
+// ExpiresAt returns the expiry of the last fetched credentials
+func (cp *CredentialProvider) ExpiresAt() time.Time {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	return cp.ExpirationDate
+}
+
+// Name returns the name of the credentials provider, e.g. vault
+func (cp *CredentialProvider) Name() string {
+	return cp.name
+}
+
+// LastRefresh returns when credentials were fetched successfully for the last time
+func (cp *CredentialProvider) LastRefresh() time.Time {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	return cp.lastRefresh
 }
 
 func (cp *CredentialProvider) IsExpired() bool {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
 	return time.Now().After(cp.ExpirationDate.Add(-time.Second * 60))
 }
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentRequestsShareOneCredentialsFetch(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	client := &testhelper.ReadClient{Delay: 200 * time.Millisecond}
+	credentials := NewCredentials(client)
+	target, _ := url.Parse(upstream.URL)
+	signingProxy := NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		Credentials:     credentials,
+	})
+	deduplicatedBefore := testutil.ToFloat64(credentialsFetchDeduplicatedCounter)
+
+	var started, wg sync.WaitGroup
+	started.Add(1)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Wait()
+			rec := httptest.NewRecorder()
+			signingProxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_search", nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}()
+	}
+	started.Done()
+	wg.Wait()
+
+	assert.Equal(t, 1, client.Calls())
+	assert.Equal(t, float64(49), testutil.ToFloat64(credentialsFetchDeduplicatedCounter)-deduplicatedBefore)
+	assert.False(t, credentials.Provider.IsExpired())
+
+	// cached credentials are not counted
+	rec := httptest.NewRecorder()
+	signingProxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_search", nil))
+	assert.Equal(t, float64(49), testutil.ToFloat64(credentialsFetchDeduplicatedCounter)-deduplicatedBefore)
+}
+
+func TestRefreshFetchesCredentialsOnce(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	client := &testhelper.ReadClient{}
+	credentials := NewCredentials(client)
+	_, err := credentials.Get()
+	assert.NoError(t, err)
+
+	value, err := credentials.Refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "accessKey", value.AccessKeyID)
+	assert.Equal(t, 2, client.Calls())
+
+	// the refreshed credentials are handed out only once, later retrievals fetch again
+	credentials.Expire()
+	_, err = credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, client.Calls())
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"net"
+	"net/http"
+)
+
+var ErrUpstreamUnavailable = errors.New("upstream circuit breaker is open")
+
+// breakerTransport guards the upstream with a circuit breaker. Answers with 5xx or 429 and timeouts count as failures,
+// and while the circuit is open requests fail fast instead of adding load to an overloaded upstream.
+// Without a breaker of its own, the breaker of the target the request is sent to is used, if it has one.
+type breakerTransport struct {
+	breaker *circuitbreaker.CircuitBreaker
+	exempt  *Routes
+	next    http.RoundTripper
+}
+
+func newBreakerTransport(breaker *circuitbreaker.CircuitBreaker, exempt *Routes, next http.RoundTripper) *breakerTransport {
+	if exempt == nil {
+		exempt = NewRoutes(nil)
+	}
+	return &breakerTransport{
+		breaker: breaker,
+		exempt:  exempt,
+		next:    next,
+	}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.exempt.Matches(req.URL.Path) {
+		return t.next.RoundTrip(req)
+	}
+
+	breaker := t.breaker
+	if breaker == nil {
+		if target, ok := targetFromContext(req.Context()); ok {
+			breaker = target.breaker
+		}
+	}
+	if breaker == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	done, err := breaker.Allow()
+	if err != nil {
+		upstreamRejectedCounter.Inc()
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	reason := upstreamFailure(resp, err)
+	if reason != "" {
+		upstreamFailuresCounter.WithLabelValues(reason).Inc()
+	}
+	done(reason == "")
+	return resp, err
+}
+
+// upstreamFailure returns why the round trip counts as an upstream failure or an empty string if it does not.
+// Requests cancelled by the client, bodies exceeding the limit and missing credentials are not the fault of the upstream,
+// requests rejected by an open circuit breaker have been counted already.
+func upstreamFailure(resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, ErrCredentialsUnavailable) || errors.Is(err, ErrUpstreamUnavailable) || requestTooLarge(err) {
+			return ""
+		}
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return "timeout"
+		}
+		return "error"
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "throttled"
+	case resp.StatusCode >= 500:
+		return "server_error"
+	}
+	return ""
+}
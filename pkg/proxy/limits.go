@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// LimitRequestBody answers with 413 if the request body is larger than maxBytes, 0 disables the limit.
+// Requests announcing a larger Content-Length are rejected at once, any other body fails with *http.MaxBytesError
+// as soon as it is read beyond the limit, which happens before it is buffered for signing.
+func LimitRequestBody(next http.Handler, maxBytes int64) http.Handler {
+	if maxBytes <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > maxBytes {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func requestTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
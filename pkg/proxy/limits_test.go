@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	handler := LimitRequestBody(NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{ExpiresIn: time.Hour},
+	}), 8)
+
+	serve := func(body string, contentLength int64) int {
+		req := httptest.NewRequest(http.MethodPost, "/_bulk", strings.NewReader(body))
+		req.ContentLength = contentLength
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("12345678", 8))
+	assert.Equal(t, "12345678", received)
+
+	received = ""
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("123456789", 9))
+	// bodies of unknown length are cut off while being read for signing
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("123456789", -1))
+	assert.Empty(t, received, "oversized bodies must not be forwarded")
+}
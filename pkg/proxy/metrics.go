@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sizeBuckets = prometheus.ExponentialBuckets(128, 4, 10)
+
+// maxAwsErrorCodes bounds the number of values of the aws_error_code label, further error codes are counted as "other"
+const maxAwsErrorCodes = 50
+
+var (
+	awsErrorCodePattern = regexp.MustCompile(`^[A-Za-z0-9_.]{1,64}$`)
+	awsErrorCodeLabels  = newBoundedLabels(maxAwsErrorCodes)
+)
+
+var (
+	requestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Number of proxied requests",
+	}, []string{"method", "route", "status_class", "aws_error_code"})
+	requestDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Duration of proxied requests including signing and the upstream round trip",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status_class"})
+	requestsInFlightGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_requests_in_flight",
+		Help: "Number of proxied requests currently being served",
+	})
+	requestSizeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_size_bytes",
+		Help:    "Size of the bodies of proxied requests",
+		Buckets: sizeBuckets,
+	}, []string{"method", "route"})
+	responseSizeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_response_size_bytes",
+		Help:    "Size of the bodies of proxied responses",
+		Buckets: sizeBuckets,
+	}, []string{"method", "route"})
+	signingDurationHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_signing_duration_seconds",
+		Help:    "Duration of signing requests including the retrieval of credentials",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+	upstreamFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_failures_total",
+		Help: "Number of proxied requests counted as failures by the upstream circuit breaker by reason (server_error, throttled, timeout, error)",
+	}, []string{"reason"})
+	upstreamRejectedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_upstream_rejected_total",
+		Help: "Number of proxied requests rejected because the upstream circuit breaker is open",
+	})
+	retriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_retries_total",
+		Help: "Number of retried upstream requests by reason (status code, throttled, error)",
+	}, []string{"method", "reason"})
+	retryBudgetExhaustedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_retry_budget_exhausted_total",
+		Help: "Number of retries skipped because the retry budget was exhausted",
+	})
+	targetHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_target_healthy",
+		Help: "Whether a target of the target group is considered healthy (1) or not (0)",
+	}, []string{"target"})
+	credentialsFetchesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "credentials_fetches_total",
+		Help: "Number of credential fetches by provider and outcome (success, fallback, failure)",
+	}, []string{"provider", "outcome"})
+	credentialsExpiryGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "credentials_expiry_timestamp_seconds",
+		Help: "Unix timestamp at which the current credentials expire",
+	}, []string{"provider"})
+	credentialsRefreshAttemptsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "credentials_refresh_attempts_total",
+		Help: "Number of attempts to fetch new credentials from the credentials provider by outcome (success, failure)",
+	}, []string{"provider", "outcome"})
+	credentialsRefreshDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "credentials_refresh_duration_seconds",
+		Help:    "Duration of fetching new credentials from the credentials provider",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+	credentialsRemaining = newRemainingCollector()
+)
+
+// ObserveRefresh records an attempt of a credentials provider to fetch new credentials, e.g. from Vault or AWS STS
+func ObserveRefresh(provider string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	credentialsRefreshAttemptsCounter.WithLabelValues(provider, outcome).Inc()
+	credentialsRefreshDurationHistogram.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+}
+
+// remainingCollector computes the seconds until the credentials of each provider expire at scrape time
+type remainingCollector struct {
+	desc      *prometheus.Desc
+	mutex     sync.RWMutex
+	providers map[string]*CredentialProvider
+}
+
+func newRemainingCollector() *remainingCollector {
+	c := &remainingCollector{
+		desc: prometheus.NewDesc(
+			"credentials_expiry_remaining_seconds",
+			"Seconds until the current credentials expire",
+			[]string{"provider"}, nil,
+		),
+		providers: map[string]*CredentialProvider{},
+	}
+	prometheus.MustRegister(c)
+	return c
+}
+
+func (c *remainingCollector) register(provider *CredentialProvider) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.providers[provider.name] = provider
+}
+
+func (c *remainingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *remainingCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for name, provider := range c.providers {
+		expiresAt := provider.ExpiresAt()
+		if expiresAt.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Until(expiresAt).Seconds(), name)
+	}
+}
+
+// InstrumentHandler records metrics of every proxied request. The path is mapped onto a route template to keep the label cardinality bounded.
+func InstrumentHandler(next http.Handler, routes *Routes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestsInFlightGauge.Inc()
+		defer requestsInFlightGauge.Dec()
+
+		route := routes.Template(req.URL.Path)
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		rw := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rw, req)
+
+		status := rw.statusCode()
+		statusClass := strconv.Itoa(status/100) + "xx"
+		requestsCounter.WithLabelValues(req.Method, route, statusClass, awsErrorCodeLabels.value(rw.awsErrorCode)).Inc()
+		requestDurationHistogram.WithLabelValues(req.Method, route, statusClass).Observe(time.Since(start).Seconds())
+		requestSizeHistogram.WithLabelValues(req.Method, route).Observe(float64(body.bytes))
+		responseSizeHistogram.WithLabelValues(req.Method, route).Observe(float64(rw.bytes))
+	})
+}
+
+// awsErrorCode extracts the error code from the x-amzn-ErrorType header, e.g. "ResourceNotFoundException:http://internal.amazon.com/..."
+func awsErrorCode(header http.Header) string {
+	errorType := header.Get("X-Amzn-Errortype")
+	if i := strings.IndexAny(errorType, ":#"); i >= 0 {
+		errorType = errorType[:i]
+	}
+	return errorType
+}
+
+// boundedLabels passes label values through until limit distinct values have been seen, any other value becomes "other"
+type boundedLabels struct {
+	mutex  sync.Mutex
+	limit  int
+	values map[string]struct{}
+}
+
+func newBoundedLabels(limit int) *boundedLabels {
+	return &boundedLabels{limit: limit, values: map[string]struct{}{}}
+}
+
+func (b *boundedLabels) value(value string) string {
+	if value == "" {
+		return value
+	}
+	if !awsErrorCodePattern.MatchString(value) {
+		return "other"
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.values[value]; ok {
+		return value
+	}
+	if len(b.values) >= b.limit {
+		return "other"
+	}
+	b.values[value] = struct{}{}
+	return value
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// statusRecorder captures status code, size and AWS error code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	awsErrorCode string
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if s.status == 0 {
+		s.status = statusCode
+		s.awsErrorCode = awsErrorCode(s.Header())
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) statusCode() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// Flush keeps streaming responses working when a flush interval is configured
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps protocol upgrades working
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	routes := NewRoutes([]string{"/{index}/_doc/{id}", "/my-bucket/*"})
+
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/_cluster/health", "/_cluster/health"},
+		{"/_cat/indices/logs-2023.01.01", "/_cat/indices/{param}"},
+		{"/logs-2023.01.01/_search", "/{param}/_search"},
+		{"/logs-2023.01.01/_doc/4711", "/{index}/_doc/{id}"},
+		{"/my-bucket/some/deeply/nested/key.json", "/my-bucket/*"},
+		{"/other-bucket/some/deeply/nested/key.json", "/{param}/{param}/{param}/..."},
+		{"/index/_doc/_Ab3-4711", "/{index}/_doc/{id}"},
+		{"/index/_update/_Ab3-4711", "/{param}/_update/{param}"},
+		// only known API endpoints and sub-resources are kept
+		{"/_made_up/anything", "/{param}/{param}"},
+		{"/_cluster/whatever", "/_cluster/{param}"},
+		{"/index/_abc", "/{param}/{param}"},
+		{"/index/_search/_abc", "/{param}/_search/{param}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, tc.want, routes.Template(tc.path))
+		})
+	}
+
+	assert.True(t, routes.Matches("/my-bucket/key"))
+	assert.False(t, routes.Matches("/_cluster/health"))
+}
+
+func TestInstrumentHandler(t *testing.T) {
+
+	handler := InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-ErrorType", "index_not_found_exception:http://internal.amazon.com/coral/com.amazon.opensearch/")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("not found"))
+	}), NewRoutes(nil))
+
+	counter := requestsCounter.WithLabelValues(http.MethodPost, "/{param}/_search", "4xx", "index_not_found_exception")
+	before := testutil.ToFloat64(counter)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/missing-index/_search", strings.NewReader(`{"query":{}}`)))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+	assert.Equal(t, float64(0), testutil.ToFloat64(requestsInFlightGauge))
+}
+
+func TestBoundedLabels(t *testing.T) {
+
+	labels := newBoundedLabels(2)
+
+	assert.Equal(t, "", labels.value(""))
+	assert.Equal(t, "ThrottlingException", labels.value("ThrottlingException"))
+	assert.Equal(t, "index_not_found_exception", labels.value("index_not_found_exception"))
+	assert.Equal(t, "other", labels.value("ValidationException"))
+	// values seen before the limit was reached are kept
+	assert.Equal(t, "ThrottlingException", labels.value("ThrottlingException"))
+	assert.Equal(t, "other", newBoundedLabels(2).value("<script>"))
+	assert.Equal(t, "other", newBoundedLabels(2).value(strings.Repeat("x", 65)))
+}
+
+func TestCredentialExpiryMetrics(t *testing.T) {
+
+	provider := NewCredentialProvider(&testhelper.ReadClient{})
+	_, err := provider.Retrieve()
+	assert.NoError(t, err)
+
+	expiresAt := provider.ExpiresAt()
+	assert.Equal(t, float64(expiresAt.Unix()), testutil.ToFloat64(credentialsExpiryGauge.WithLabelValues("custom")))
+
+	remaining := testutil.ToFloat64(credentialsRemaining)
+	assert.InDelta(t, time.Hour.Seconds(), remaining, 5)
+}
+
+func TestObserveRefresh(t *testing.T) {
+
+	successesBefore := testutil.ToFloat64(credentialsRefreshAttemptsCounter.WithLabelValues("test", "success"))
+	failuresBefore := testutil.ToFloat64(credentialsRefreshAttemptsCounter.WithLabelValues("test", "failure"))
+
+	ObserveRefresh("test", time.Now(), nil)
+	ObserveRefresh("test", time.Now(), errors.New("auth server unavailable"))
+	ObserveRefresh("test", time.Now(), errors.New("auth server unavailable"))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(credentialsRefreshAttemptsCounter.WithLabelValues("test", "success"))-successesBefore)
+	assert.Equal(t, float64(2), testutil.ToFloat64(credentialsRefreshAttemptsCounter.WithLabelValues("test", "failure"))-failuresBefore)
+	assert.Equal(t, 1, testutil.CollectAndCount(credentialsRefreshDurationHistogram, "credentials_refresh_duration_seconds"))
+}
@@ -2,11 +2,18 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
 	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/idealo/aws-signing-proxy/pkg/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"io"
 	"net"
@@ -24,111 +31,210 @@ type Config struct {
 	IdleConnTimeout time.Duration
 	DialTimeout     time.Duration
 	AuthClient      ReadClient
+	// Transport tunes the connections to the upstream, see TransportConfig for the defaults of unset settings
+	Transport TransportConfig
+	// Credentials used for signing, built from AuthClient if not set
+	Credentials *Credentials
+	// UpstreamBreaker optionally guards the upstream, requests to UpstreamBreakerExemptRoutes bypass it.
+	// The targets of a TargetGroup are guarded by their own circuit breakers instead.
+	UpstreamBreaker             *circuitbreaker.CircuitBreaker
+	UpstreamBreakerExemptRoutes *Routes
+	Retry                       RetryPolicy
+	// Targets optionally replaces Target with a group of equivalent targets, each signed for its own region
+	Targets *TargetGroup
+	// SignatureDebug logs the canonical request and the string-to-sign of every request.
+	// Clients within SignatureDebugTrustedNetworks can enable it for single requests by sending SignatureDebugHeader.
+	SignatureDebug                bool
+	SignatureDebugHeader          string
+	SignatureDebugTrustedNetworks []*net.IPNet
 }
 
 // NewSigningProxy proxies requests to AWS services which require URL signing using the provided credentials
 func NewSigningProxy(config Config) *httputil.ReverseProxy {
-	// transport is http.DefaultTransport but with the ability to override some
-	// timeouts
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   config.DialTimeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:        100,
-		IdleConnTimeout:     config.IdleConnTimeout,
-		TLSHandshakeTimeout: 10 * time.Second,
+	transport := NewTransport(config)
+
+	// every attempt to reach the upstream gets its own span, whose context is propagated via traceparent
+	var roundTripper http.RoundTripper = newSigningTransport(config, otelhttp.NewTransport(transport))
+	if config.Targets != nil {
+		config.Targets.probeTransport = roundTripper
+		if config.Targets.guarded() {
+			// below the target selection, so every target is guarded by its own breaker
+			roundTripper = newBreakerTransport(nil, config.UpstreamBreakerExemptRoutes, roundTripper)
+		}
+		roundTripper = &failoverTransport{group: config.Targets, next: roundTripper}
+	}
+	if config.Retry.Retries > 0 {
+		roundTripper = newRetryTransport(config.Retry, roundTripper)
+	}
+	if config.UpstreamBreaker != nil {
+		roundTripper = newBreakerTransport(config.UpstreamBreaker, config.UpstreamBreakerExemptRoutes, roundTripper)
 	}
 
 	return &httputil.ReverseProxy{
 		Director:      director(config),
 		FlushInterval: config.FlushInterval,
-		Transport:     transport,
+		Transport:     roundTripper,
+		ErrorHandler:  errorHandler,
 	}
 }
 
 func director(config Config) func(req *http.Request) {
-	credentials := NewCredChain(config.AuthClient)
-
 	return func(req *http.Request) {
 		// Rewrite request to desired server host
 		req.URL.Scheme = config.Target.Scheme
 		req.URL.Host = config.Target.Host
 		req.Host = config.Target.Host
+	}
+}
 
-		if _, err := credentials.Get(); err != nil {
-			// We couldn't get any credentials
-			Logger.Error("Something went wrong", zap.Error(err))
-			return
-		}
+// errorHandler answers with 503 if no valid credentials are available or the upstream circuit breaker is open,
+// with 413 if the request body exceeds the limit and with 502 for any other upstream error
+func errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	if requestTooLarge(err) {
+		Logger.Info("Rejected request body exceeding the limit", zap.String("path", req.URL.Path))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 
-		// To perform the signing, we leverage aws-sdk-go
-		// aws.request performs more functions than we need here
-		// we only populate enough of the fields to successfully
-		// sign the request
-		c := aws.NewConfig().
-			WithCredentials(credentials).
-			WithRegion(config.Region)
+	status := http.StatusBadGateway
+	if errors.Is(err, ErrCredentialsUnavailable) || errors.Is(err, ErrUpstreamUnavailable) {
+		status = http.StatusServiceUnavailable
+	}
 
-		clientInfo := metadata.ClientInfo{
-			ServiceName: config.Service,
-		}
+	Logger.Error("Something went wrong", zap.Error(err), zap.Int("status", status))
+	w.WriteHeader(status)
+}
 
-		operation := &request.Operation{
-			Name:       "",
-			HTTPMethod: req.Method,
-			HTTPPath:   req.URL.Path,
-		}
+// signingTransport signs every outgoing request right before handing it over to the next http.RoundTripper
+type signingTransport struct {
+	config      Config
+	credentials *Credentials
+	debug       signatureDebug
+	next        http.RoundTripper
+}
 
-		handlers := request.Handlers{}
-		handlers.Sign.PushBack(v4.SignSDKRequest)
-
-		// Do we need to use request.New ? Or can we create a raw Request struct and
-		//  jus swap out the HTTPRequest with our own existing one?
-		awsReq := request.New(*c, clientInfo, handlers, nil, operation, nil, nil)
-		// Referenced during the execution of awsReq.Sign():
-		//  req.Config.Credentials
-		//  req.Config.LogLevel.Value()
-		//  req.Config.Logger
-		//  req.ClientInfo.SigningRegion (will default to Config.Region)
-		//  req.ClientInfo.SigningName (will default to ServiceName)
-		//  req.ClientInfo.ServiceName
-		//  req.HTTPRequest
-		//  req.Time
-		//  req.ExpireTime
-		//  req.Body
-
-		// Set the body in the awsReq for calculation of body Digest
-		// iotuil.ReadAll reads the Body from the stream so it can be copied into awsReq
-		// This drains the body from the original (proxied) request.
-		// To fix, we replace req.Body with a copy (NopCloser provides io.ReadCloser interface)
-		if req.Body != nil {
-			buf, err := io.ReadAll(req.Body)
-			if err != nil {
-				Logger.Error("Error reading request body", zap.Error(err))
-			}
-			req.Body = io.NopCloser(bytes.NewBuffer(buf))
+func newSigningTransport(config Config, next http.RoundTripper) *signingTransport {
+	if config.Credentials == nil {
+		config.Credentials = NewCredentials(config.AuthClient)
+	}
+	return &signingTransport{
+		config:      config,
+		credentials: config.Credentials,
+		debug:       newSignatureDebug(config),
+		next:        next,
+	}
+}
 
-			awsReq.SetBufferBody(buf)
-		}
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), "sign")
+	capture := t.debug.capture(req)
+	start := time.Now()
+	err := t.sign(ctx, req, capture)
+	signingDurationHistogram.Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
 
-		// Use the updated req.URL for creating the signed request
-		// We pass the full URL object to include Host, Scheme, and any params
-		awsReq.HTTPRequest.URL = req.URL
-		// These are now set above via req, but it's imperative that this remains
-		//  correctly set before calling .Sign()
-		//awsReq.HTTPRequest.URL.Scheme = target.Scheme
-		//awsReq.HTTPRequest.URL.Host = target.Host
-
-		// Perform the signing, updating awsReq in place
-		if err := awsReq.Sign(); err != nil {
-			Logger.Error("Error while signing", zap.Error(err))
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
 		}
+		return nil, err
+	}
 
-		// Write the Signed Headers into the Original Request
-		for k, v := range awsReq.HTTPRequest.Header {
-			req.Header[k] = v
+	resp, err := t.next.RoundTrip(req)
+	if capture != nil && err == nil {
+		capture.compare(resp)
+	}
+	return resp, err
+}
+
+// sign signs the request in place, capture receives the canonical request and the string-to-sign if it is not nil
+func (t *signingTransport) sign(ctx context.Context, req *http.Request, capture *signatureCapture) error {
+	value, err := t.credentials.GetWithContext(ctx)
+	if err != nil {
+		// We couldn't get any credentials
+		return fmt.Errorf("%w: %v", ErrCredentialsUnavailable, err)
+	}
+	if info, ok := requestInfoFromContext(req.Context()); ok {
+		info.signedBy(value.AccessKeyID, req.URL.Host)
+	}
+
+	// To perform the signing, we leverage aws-sdk-go
+	// aws.request performs more functions than we need here
+	// we only populate enough of the fields to successfully
+	// sign the request
+	region := t.config.Region
+	if target, ok := targetFromContext(req.Context()); ok && target.Region != "" {
+		region = target.Region
+	}
+
+	c := aws.NewConfig().
+		WithCredentials(t.credentials.Credentials).
+		WithRegion(region)
+	if capture != nil {
+		c = c.WithLogLevel(aws.LogDebugWithSigning).WithLogger(capture)
+	}
+
+	clientInfo := metadata.ClientInfo{
+		ServiceName: t.config.Service,
+	}
+
+	operation := &request.Operation{
+		Name:       "",
+		HTTPMethod: req.Method,
+		HTTPPath:   req.URL.Path,
+	}
+
+	handlers := request.Handlers{}
+	handlers.Sign.PushBack(v4.SignSDKRequest)
+
+	// Do we need to use request.New ? Or can we create a raw Request struct and
+	//  jus swap out the HTTPRequest with our own existing one?
+	awsReq := request.New(*c, clientInfo, handlers, nil, operation, nil, nil)
+	// Referenced during the execution of awsReq.Sign():
+	//  req.Config.Credentials
+	//  req.Config.LogLevel.Value()
+	//  req.Config.Logger
+	//  req.ClientInfo.SigningRegion (will default to Config.Region)
+	//  req.ClientInfo.SigningName (will default to ServiceName)
+	//  req.ClientInfo.ServiceName
+	//  req.HTTPRequest
+	//  req.Time
+	//  req.ExpireTime
+	//  req.Body
+
+	// Set the body in the awsReq for calculation of body Digest
+	// iotuil.ReadAll reads the Body from the stream so it can be copied into awsReq
+	// This drains the body from the original (proxied) request.
+	// To fix, we replace req.Body with a copy (NopCloser provides io.ReadCloser interface)
+	if req.Body != nil {
+		buf, err := io.ReadAll(req.Body)
+		if err != nil {
+			return fmt.Errorf("failed reading request body: %w", err)
 		}
+		req.Body = io.NopCloser(bytes.NewBuffer(buf))
+
+		awsReq.SetBufferBody(buf)
+	}
+
+	// Use the updated req.URL for creating the signed request
+	// We pass the full URL object to include Host, Scheme, and any params
+	awsReq.HTTPRequest.URL = req.URL
+	// These are now set above via req, but it's imperative that this remains
+	//  correctly set before calling .Sign()
+	//awsReq.HTTPRequest.URL.Scheme = target.Scheme
+	//awsReq.HTTPRequest.URL.Host = target.Host
+
+	// Perform the signing, updating awsReq in place
+	if err := awsReq.Sign(); err != nil {
+		Logger.Error("Error while signing", zap.Error(err))
+	}
+
+	// Write the Signed Headers into the Original Request
+	for k, v := range awsReq.HTTPRequest.Header {
+		req.Header[k] = v
+	}
+	if capture != nil {
+		capture.signed(req.Header)
 	}
+	return nil
 }
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSigningProxySignsRequests(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	rec := proxyRequest(upstream, &testhelper.ReadClient{ExpiresIn: time.Hour})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=accessKey/"), authorization)
+}
+
+func TestSigningProxyAnswersServiceUnavailableWithoutCredentials(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	called := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+
+	rec := proxyRequest(upstream, &testhelper.ReadClient{Failing: true})
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.False(t, called, "unsigned request must not be forwarded")
+}
+
+func TestRetrieveFallsBackToLastKnownGoodCredentials(t *testing.T) {
+
+	client := &testhelper.ReadClient{ExpiresIn: time.Hour}
+	provider := NewCredentialProvider(client)
+
+	_, err := provider.Retrieve()
+	assert.NoError(t, err)
+
+	client.SetFailing(true)
+	value, err := provider.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "accessKey", value.AccessKeyID)
+
+	// the last known good credentials have expired
+	provider.lastKnownGood.ExpiresAt = time.Now().Add(-time.Second)
+	value, err = provider.Retrieve()
+	assert.ErrorIs(t, err, ErrCredentialsUnavailable)
+	assert.Empty(t, value.AccessKeyID)
+}
+
+func TestUpstreamCircuitBreakerFailsFast(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/_cluster/health" {
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	signingProxy := NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{ExpiresIn: time.Hour},
+		UpstreamBreaker: circuitbreaker.NewCircuitBreakerWithSettings("upstream-test", circuitbreaker.Settings{
+			Timeout:          time.Minute,
+			FailureThreshold: math.MaxUint32,
+			FailureRatio:     0.5,
+			MinRequests:      4,
+		}),
+		UpstreamBreakerExemptRoutes: NewRoutes([]string{"/_cluster/health"}),
+	})
+	serve := func(path string) int {
+		rec := httptest.NewRecorder()
+		signingProxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, serve("/logs/_search"))
+	}
+	rejectedBefore := testutil.ToFloat64(upstreamRejectedCounter)
+
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/logs/_search"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "requests must not reach the upstream while the circuit is open")
+	assert.Equal(t, float64(1), testutil.ToFloat64(upstreamRejectedCounter)-rejectedBefore)
+
+	// exempt routes bypass the breaker
+	assert.Equal(t, http.StatusOK, serve("/_cluster/health"))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	assert.Equal(t, "", upstreamFailure(&http.Response{StatusCode: http.StatusNotFound}, nil))
+	assert.Equal(t, "throttled", upstreamFailure(&http.Response{StatusCode: http.StatusTooManyRequests}, nil))
+	assert.Equal(t, "server_error", upstreamFailure(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+	assert.Equal(t, "timeout", upstreamFailure(nil, context.DeadlineExceeded))
+	assert.Equal(t, "error", upstreamFailure(nil, errors.New("connection reset by peer")))
+	assert.Equal(t, "", upstreamFailure(nil, context.Canceled))
+	assert.Equal(t, "", upstreamFailure(nil, fmt.Errorf("%w: expired", ErrCredentialsUnavailable)))
+}
+
+func proxyRequest(upstream *httptest.Server, client ReadClient) *httptest.ResponseRecorder {
+	target, _ := url.Parse(upstream.URL)
+	signingProxy := NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      client,
+	})
+
+	rec := httptest.NewRecorder()
+	signingProxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_cluster/health", nil))
+	return rec
+}
+
+// withoutEnvironmentCredentials makes sure the credentials chain does not pick up credentials of the machine running the tests
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures which proxied requests are retried and how often
+type RetryPolicy struct {
+	// Retries is the maximum number of retries of a single request, 0 disables retries
+	Retries int
+	// Methods are the idempotent methods which are retried
+	Methods []string
+	// SafeOperations are AWS operations (the X-Amz-Target header, e.g. DynamoDB_20120810.GetItem or just GetItem)
+	// which are retried regardless of their method
+	SafeOperations []string
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	// Budget is the maximum number of retries which can be spent at once. Every request which does not need
+	// to be retried refills the budget by BudgetRatio, so retries cannot multiply the load of a struggling upstream.
+	Budget      float64
+	BudgetRatio float64
+}
+
+// retryTransport retries failed round trips of idempotent requests. Every attempt goes through the next
+// http.RoundTripper again, so it is signed again with a fresh X-Amz-Date.
+type retryTransport struct {
+	policy  RetryPolicy
+	methods map[string]bool
+	budget  *retryBudget
+	next    http.RoundTripper
+}
+
+func newRetryTransport(policy RetryPolicy, next http.RoundTripper) *retryTransport {
+	methods := map[string]bool{}
+	for _, method := range policy.Methods {
+		methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+	return &retryTransport{
+		policy:  policy,
+		methods: methods,
+		budget:  newRetryBudget(policy.Budget, policy.BudgetRatio),
+		next:    next,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.retryable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(withBody(req, body))
+
+		reason := retryReason(resp, err)
+		if reason == "" {
+			t.budget.deposit()
+			return resp, err
+		}
+		if attempt >= t.policy.Retries {
+			return resp, err
+		}
+
+		wait := t.backoff(attempt + 1)
+		if retryAfter, ok := parseRetryAfter(resp); ok {
+			if retryAfter > t.policy.MaxBackoff {
+				// the upstream asks to back off longer than we are willing to hold the client
+				return resp, err
+			}
+			wait = retryAfter
+		}
+
+		if !t.budget.withdraw() {
+			retryBudgetExhaustedCounter.Inc()
+			return resp, err
+		}
+		retriesCounter.WithLabelValues(req.Method, reason).Inc()
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		if !sleep(req.Context(), wait) {
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t *retryTransport) retryable(req *http.Request) bool {
+	if t.methods[req.Method] {
+		return true
+	}
+
+	target := req.Header.Get("X-Amz-Target")
+	if target == "" {
+		return false
+	}
+	operation := target[strings.LastIndex(target, ".")+1:]
+	for _, safeOperation := range t.policy.SafeOperations {
+		if safeOperation == target || safeOperation == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff doubles the wait time with every retry and adds up to 50% jitter
+func (t *retryTransport) backoff(retry int) time.Duration {
+	wait := t.policy.MinBackoff
+	for i := 1; i < retry && wait < t.policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > t.policy.MaxBackoff {
+		wait = t.policy.MaxBackoff
+	}
+	if wait/2 > 0 {
+		wait += time.Duration(rand.Int63n(int64(wait / 2)))
+	}
+	return wait
+}
+
+// retryReason returns why the round trip should be retried or an empty string if it should not
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, ErrCredentialsUnavailable) || errors.Is(err, ErrUpstreamUnavailable) {
+			return ""
+		}
+		return "error"
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return "throttled"
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// parseRetryAfter reads the Retry-After header, which is either a number of seconds or an http date
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// withBody clones the request for another attempt, so headers set while signing a previous attempt do not leak into it
+func withBody(req *http.Request, body []byte) *http.Request {
+	attempt := req.Clone(req.Context())
+	if body == nil {
+		attempt.Body = nil
+		return attempt
+	}
+	attempt.Body = io.NopCloser(bytes.NewReader(body))
+	attempt.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	attempt.ContentLength = int64(len(body))
+	return attempt
+}
+
+func sleep(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryBudget is a token bucket limiting the share of retries
+type retryBudget struct {
+	mutex  sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+func newRetryBudget(max float64, ratio float64) *retryBudget {
+	return &retryBudget{tokens: max, max: max, ratio: ratio}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *retryBudget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
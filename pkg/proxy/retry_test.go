@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedAttempt struct {
+	body    string
+	amzDate string
+}
+
+func TestRetriesAreSignedAgain(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	var mutex sync.Mutex
+	var attempts []recordedAttempt
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts = append(attempts, recordedAttempt{body: string(body), amzDate: r.Header.Get("X-Amz-Date")})
+		if len(attempts) < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	retriesBefore := testutil.ToFloat64(retriesCounter.WithLabelValues(http.MethodPut, "503"))
+	rec := serveWithRetries(upstream, RetryPolicy{Retries: 3, Methods: []string{"PUT"}, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Second, Budget: 10, BudgetRatio: 0.1},
+		httptest.NewRequest(http.MethodPut, "/logs/_doc/1", strings.NewReader(`{"message":"hello"}`)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, attempts, 3)
+	for _, attempt := range attempts {
+		assert.Equal(t, `{"message":"hello"}`, attempt.body)
+	}
+	// Retry-After is honoured, so the attempts are signed at different times
+	assert.NotEqual(t, attempts[0].amzDate, attempts[1].amzDate)
+	assert.Equal(t, float64(2), testutil.ToFloat64(retriesCounter.WithLabelValues(http.MethodPut, "503"))-retriesBefore)
+}
+
+func TestNonIdempotentRequestsAreNotRetried(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	policy := RetryPolicy{Retries: 3, Methods: []string{"GET"}, SafeOperations: []string{"GetItem"}, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Budget: 10}
+
+	rec := serveWithRetries(upstream, policy, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}")))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 1, calls)
+
+	// retry-safe AWS operations are retried regardless of their method
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810.GetItem")
+	rec = serveWithRetries(upstream, policy, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 5, calls)
+}
+
+func TestRetryBudget(t *testing.T) {
+
+	budget := newRetryBudget(2, 0.5)
+	assert.True(t, budget.withdraw())
+	assert.True(t, budget.withdraw())
+	assert.False(t, budget.withdraw())
+
+	budget.deposit()
+	assert.False(t, budget.withdraw())
+	budget.deposit()
+	assert.True(t, budget.withdraw())
+
+	for i := 0; i < 10; i++ {
+		budget.deposit()
+	}
+	assert.Equal(t, float64(2), budget.tokens)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	resp := &http.Response{Header: http.Header{}}
+	_, ok := parseRetryAfter(resp)
+	assert.False(t, ok)
+
+	resp.Header.Set("Retry-After", "3")
+	wait, ok := parseRetryAfter(resp)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	wait, ok = parseRetryAfter(resp)
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute.Seconds(), wait.Seconds(), 2)
+}
+
+func serveWithRetries(upstream *httptest.Server, policy RetryPolicy, req *http.Request) *httptest.ResponseRecorder {
+	target, _ := url.Parse(upstream.URL)
+	signingProxy := NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{ExpiresIn: time.Hour},
+		Retry:           policy,
+	})
+
+	rec := httptest.NewRecorder()
+	signingProxy.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"strings"
+)
+
+const (
+	maxRouteSegments = 3
+	routePlaceholder = "{param}"
+)
+
+// Routes maps request paths onto route templates like /{index}/_search, so metric labels stay bounded.
+// Paths which match none of the configured templates are templated generically.
+type Routes struct {
+	templates [][]string
+}
+
+func NewRoutes(templates []string) *Routes {
+	r := &Routes{}
+	for _, template := range templates {
+		template = strings.TrimSpace(template)
+		if template == "" {
+			continue
+		}
+		r.templates = append(r.templates, splitPath(template))
+	}
+	return r
+}
+
+// Template returns the first configured template matching the path.
+// Otherwise, known API endpoints (like _search or _cluster) are kept, as well as the known sub-resources
+// of a cluster level API (e.g. /_cluster/health). Every other segment is replaced by a placeholder and
+// the path is cut after a few segments, so clients cannot make up new label values.
+func (r *Routes) Template(path string) string {
+	segments := splitPath(path)
+
+	if template := r.match(segments); template != nil {
+		return "/" + strings.Join(template, "/")
+	}
+
+	templated := make([]string, 0, maxRouteSegments+1)
+	for i, segment := range segments {
+		if i == maxRouteSegments {
+			templated = append(templated, "...")
+			break
+		}
+		if _, ok := apiEndpoints[segment]; ok {
+			templated = append(templated, segment)
+		} else if _, ok := apiSubResources[segment]; ok && i == 1 && templated[0] != routePlaceholder {
+			templated = append(templated, segment)
+		} else {
+			templated = append(templated, routePlaceholder)
+		}
+	}
+	return "/" + strings.Join(templated, "/")
+}
+
+// Matches tells whether the path matches any of the configured templates
+func (r *Routes) Matches(path string) bool {
+	return r.match(splitPath(path)) != nil
+}
+
+func (r *Routes) match(segments []string) []string {
+	for _, template := range r.templates {
+		if matchesTemplate(template, segments) {
+			return template
+		}
+	}
+	return nil
+}
+
+// matchesTemplate compares segment by segment, {name} matches any single segment
+// and a trailing * matches any remaining segments
+func matchesTemplate(template []string, segments []string) bool {
+	for i, t := range template {
+		if t == "*" && i == len(template)-1 {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			continue
+		}
+		if t != segments[i] {
+			return false
+		}
+	}
+	return len(template) == len(segments)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// apiEndpoints are the endpoints of the OpenSearch and Elasticsearch APIs which are kept in route templates
+var apiEndpoints = routeKeywords(
+	"_alias", "_aliases", "_all", "_analyze", "_bulk", "_cache", "_cat", "_close", "_cluster", "_count", "_create",
+	"_data_stream", "_delete_by_query", "_doc", "_explain", "_field_caps", "_flush", "_forcemerge", "_index_template",
+	"_ingest", "_mapping", "_mappings", "_mget", "_msearch", "_mtermvectors", "_nodes", "_open", "_opendistro", "_pit",
+	"_plugins", "_ppl", "_recovery", "_refresh", "_reindex", "_rollover", "_scripts", "_search", "_security", "_segments",
+	"_settings", "_shrink", "_snapshot", "_source", "_split", "_sql", "_stats", "_tasks", "_template", "_termvectors",
+	"_update", "_update_by_query", "_validate",
+)
+
+// apiSubResources are kept as second segment after an API endpoint, e.g. /_cluster/health or /_cat/indices
+var apiSubResources = routeKeywords(
+	"aliases", "allocation", "cluster_manager", "count", "health", "hot_threads", "indices", "master", "nodes",
+	"pending_tasks", "pipeline", "plugins", "recovery", "reroute", "scroll", "segments", "settings", "shards",
+	"state", "stats", "tasks", "template", "templates", "thread_pool",
+)
+
+func routeKeywords(keywords ...string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keywords))
+	for _, keyword := range keywords {
+		set[keyword] = struct{}{}
+	}
+	return set
+}
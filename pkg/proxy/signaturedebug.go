@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"go.uber.org/zap"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maxErrorBodySize limits how much of an error response is read to find the canonical request calculated by AWS
+const maxErrorBodySize = 64 * 1024
+
+var (
+	signatureLogPattern  = regexp.MustCompile(`(?s)---\[ CANONICAL STRING  \]-+\n(.*)\n---\[ STRING TO SIGN \]-+\n(.*?)\n-{10,}`)
+	signedHeadersPattern = regexp.MustCompile(`SignedHeaders=([^,]+)`)
+	// S3 and other XML services echo the canonical request in the error document
+	xmlCanonicalRequestPattern = regexp.MustCompile(`(?s)<CanonicalRequest>(.*?)</CanonicalRequest>`)
+	// JSON services, e.g. OpenSearch, put it into the error message
+	jsonCanonicalRequestPattern = regexp.MustCompile(`(?s)The Canonical String for this request should have been\n'(.*?)'\n\nThe String-to-Sign`)
+)
+
+// signatureDebug decides which requests are signed in debug mode, either all of them or
+// those of trusted clients which ask for it by sending the debug header
+type signatureDebug struct {
+	enabled bool
+	header  string
+	trusted []*net.IPNet
+}
+
+func newSignatureDebug(config Config) signatureDebug {
+	return signatureDebug{
+		enabled: config.SignatureDebug,
+		header:  config.SignatureDebugHeader,
+		trusted: config.SignatureDebugTrustedNetworks,
+	}
+}
+
+// capture returns a capture for the signature of the request if it is signed in debug mode.
+// The debug header is removed in any case, so it is neither signed nor forwarded.
+func (d signatureDebug) capture(req *http.Request) *signatureCapture {
+	requested := false
+	if d.header != "" && req.Header.Get(d.header) != "" {
+		req.Header.Del(d.header)
+		requested = d.trustedClient(req.RemoteAddr)
+	}
+	if !d.enabled && !requested {
+		return nil
+	}
+	return &signatureCapture{method: req.Method, path: req.URL.Path}
+}
+
+// trustedClient checks the address of the connection, as X-Forwarded-For can be set by anyone
+func (d signatureDebug) trustedClient(remoteAddr string) bool {
+	return inNetworks(remoteHost(remoteAddr), d.trusted)
+}
+
+// remoteHost strips the port off the address of a connection
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func inNetworks(address string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureCapture receives the debug output of the v4 signer, which is the only way to get hold of the canonical request
+type signatureCapture struct {
+	method           string
+	path             string
+	canonicalRequest string
+	stringToSign     string
+	signedHeaders    string
+}
+
+// Log implements aws.Logger
+func (c *signatureCapture) Log(args ...interface{}) {
+	if match := signatureLogPattern.FindStringSubmatch(fmt.Sprint(args...)); match != nil {
+		c.canonicalRequest = match[1]
+		c.stringToSign = match[2]
+	}
+}
+
+func (c *signatureCapture) signed(header http.Header) {
+	if match := signedHeadersPattern.FindStringSubmatch(header.Get("Authorization")); match != nil {
+		c.signedHeaders = match[1]
+	}
+
+	Logger.Info("Signed request in signature debug mode",
+		zap.String("method", c.method),
+		zap.String("path", c.path),
+		zap.String("canonical-request", c.canonicalRequest),
+		zap.String("string-to-sign", c.stringToSign),
+		zap.String("signed-headers", c.signedHeaders),
+	)
+}
+
+// compare looks for the canonical request AWS calculated in a 403 answer and logs where it differs from the signed one
+func (c *signatureCapture) compare(resp *http.Response) {
+	if resp.StatusCode != http.StatusForbidden || resp.Body == nil {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil {
+		return
+	}
+
+	expected, ok := awsCanonicalRequest(body)
+	if !ok {
+		Logger.Info("AWS rejected the request in signature debug mode without telling its canonical request",
+			zap.String("method", c.method),
+			zap.String("path", c.path),
+			zap.String("aws-error-code", awsErrorCode(resp.Header)),
+		)
+		return
+	}
+	if expected == c.canonicalRequest {
+		Logger.Info("AWS rejected the request in signature debug mode, but calculated the same canonical request. Check the credentials, region and service.",
+			zap.String("method", c.method),
+			zap.String("path", c.path),
+		)
+		return
+	}
+
+	line, signed, calculated := firstDifference(c.canonicalRequest, expected)
+	Logger.Warn("The canonical request signed by the proxy differs from the one calculated by AWS",
+		zap.String("method", c.method),
+		zap.String("path", c.path),
+		zap.Int("line", line),
+		zap.String("signed", signed),
+		zap.String("expected", calculated),
+		zap.String("canonical-request", c.canonicalRequest),
+		zap.String("aws-canonical-request", expected),
+	)
+}
+
+// awsCanonicalRequest extracts the canonical request AWS echoes in SignatureDoesNotMatch errors
+func awsCanonicalRequest(body []byte) (string, bool) {
+	if match := xmlCanonicalRequestPattern.FindSubmatch(body); match != nil {
+		return html.UnescapeString(string(match[1])), true
+	}
+
+	// matches "message" as well as "Message"
+	var jsonError struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &jsonError); err != nil {
+		return "", false
+	}
+	if match := jsonCanonicalRequestPattern.FindStringSubmatch(jsonError.Message); match != nil {
+		return match[1], true
+	}
+	return "", false
+}
+
+// firstDifference returns the first line, counted from 1, in which both canonical requests differ
+func firstDifference(signed string, calculated string) (int, string, string) {
+	signedLines := strings.Split(signed, "\n")
+	calculatedLines := strings.Split(calculated, "\n")
+	for i := 0; i < len(signedLines) || i < len(calculatedLines); i++ {
+		var signedLine, calculatedLine string
+		if i < len(signedLines) {
+			signedLine = signedLines[i]
+		}
+		if i < len(calculatedLines) {
+			calculatedLine = calculatedLines[i]
+		}
+		if signedLine != calculatedLine {
+			return i + 1, signedLine, calculatedLine
+		}
+	}
+	return 0, "", ""
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureDebugComparesCanonicalRequest(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+	logs := observeLogs(t)
+
+	var debugHeader string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debugHeader = r.Header.Get("X-Asp-Debug-Signature")
+		if r.URL.Path == "/_cluster/health" {
+			return
+		}
+		canonicalRequest := strings.Join([]string{"GET", "/logs/_search", "", "host:" + r.Host, "x-amz-date:" + r.Header.Get("X-Amz-Date"), "", "host;x-amz-date", "e3b0c442"}, "\n")
+		w.Header().Set("x-amzn-ErrorType", "InvalidSignatureException")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprintf(w, `{"message":"The request signature we calculated does not match the signature you provided.\n\nThe Canonical String for this request should have been\n'%s'\n\nThe String-to-Sign should have been\n'AWS4-HMAC-SHA256'\n"}`,
+			strings.ReplaceAll(canonicalRequest, "\n", `\n`))
+	}))
+	defer upstream.Close()
+
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	target, _ := url.Parse(upstream.URL)
+	signingProxy := NewSigningProxy(Config{
+		Target:                        target,
+		Region:                        "eu-central-1",
+		Service:                       "es",
+		IdleConnTimeout:               time.Second,
+		DialTimeout:                   time.Second,
+		AuthClient:                    &testhelper.ReadClient{ExpiresIn: time.Hour},
+		SignatureDebugHeader:          "X-Asp-Debug-Signature",
+		SignatureDebugTrustedNetworks: []*net.IPNet{trusted},
+	})
+	serve := func(path string, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Asp-Debug-Signature", "true")
+		rec := httptest.NewRecorder()
+		signingProxy.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the header of untrusted clients is ignored
+	assert.Equal(t, http.StatusOK, serve("/_cluster/health", "203.0.113.7:4711"))
+	assert.Empty(t, debugHeader, "the debug header must not be forwarded")
+	assert.Equal(t, 0, logs.FilterMessageSnippet("signature debug mode").Len())
+
+	assert.Equal(t, http.StatusForbidden, serve("/logs/_search", "192.0.2.1:4711"))
+	assert.Empty(t, debugHeader)
+
+	signed := logs.FilterMessage("Signed request in signature debug mode").All()
+	if assert.Len(t, signed, 1) {
+		fields := signed[0].ContextMap()
+		assert.Contains(t, fields["canonical-request"], "x-amz-security-token:[REDACTED]")
+		assert.NotContains(t, fields["canonical-request"], "securityToken")
+		assert.True(t, strings.HasPrefix(fields["string-to-sign"].(string), "AWS4-HMAC-SHA256\n"), fields["string-to-sign"])
+		assert.Equal(t, "host;x-amz-date;x-amz-security-token", fields["signed-headers"])
+	}
+
+	differences := logs.FilterMessage("The canonical request signed by the proxy differs from the one calculated by AWS").All()
+	if assert.Len(t, differences, 1) {
+		fields := differences[0].ContextMap()
+		assert.Equal(t, int64(6), fields["line"])
+		assert.Equal(t, "x-amz-security-token:[REDACTED]", fields["signed"])
+		assert.Equal(t, "", fields["expected"])
+	}
+}
+
+func TestAwsCanonicalRequest(t *testing.T) {
+	canonicalRequest, ok := awsCanonicalRequest([]byte(`<Error><Code>SignatureDoesNotMatch</Code><CanonicalRequest>GET
+/bucket/key
+a=1&amp;b=2</CanonicalRequest></Error>`))
+	assert.True(t, ok)
+	assert.Equal(t, "GET\n/bucket/key\na=1&b=2", canonicalRequest)
+
+	_, ok = awsCanonicalRequest([]byte(`{"Message":"User is not authorized to perform: es:ESHttpGet"}`))
+	assert.False(t, ok)
+}
+
+func TestFirstDifference(t *testing.T) {
+	line, signed, calculated := firstDifference("GET\n/a\n\nhost:a", "GET\n/a\n\nhost:b")
+	assert.Equal(t, 4, line)
+	assert.Equal(t, "host:a", signed)
+	assert.Equal(t, "host:b", calculated)
+
+	line, _, _ = firstDifference("GET\n/a", "GET\n/a")
+	assert.Equal(t, 0, line)
+}
+
+// observeLogs replaces the Logger with a redacting observer for the duration of the test
+func observeLogs(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zap.InfoLevel)
+	previousLogger := Logger
+	Logger = zap.New(Redact(core))
+	t.Cleanup(func() {
+		Logger = previousLogger
+	})
+	return logs
+}
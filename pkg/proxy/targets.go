@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/sony/gobreaker"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type targetContextKey struct{}
+
+// Target is an endpoint of a TargetGroup. Requests to it are signed for its region.
+type Target struct {
+	URL    *url.URL
+	Region string
+
+	breaker *circuitbreaker.CircuitBreaker
+
+	mutex               sync.RWMutex
+	healthy             bool
+	consecutiveFailures int
+	unhealthySince      time.Time
+}
+
+func NewTarget(targetUrl *url.URL, region string) *Target {
+	target := &Target{URL: targetUrl, Region: region, healthy: true}
+	targetHealthyGauge.WithLabelValues(targetUrl.Host).Set(1)
+	return target
+}
+
+// WithCircuitBreaker guards the target with its own circuit breaker, so an overloaded target does not stop the traffic to the others
+func (t *Target) WithCircuitBreaker(breaker *circuitbreaker.CircuitBreaker) *Target {
+	t.breaker = breaker
+	return t
+}
+
+// CircuitBreaker returns the circuit breaker guarding the target, nil if there is none
+func (t *Target) CircuitBreaker() *circuitbreaker.CircuitBreaker {
+	return t.breaker
+}
+
+func (t *Target) Healthy() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.healthy
+}
+
+func (t *Target) setHealthy(healthy bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.consecutiveFailures = 0
+	if !healthy {
+		// restarts the cooldown if a target keeps failing after it got traffic again
+		t.unhealthySince = time.Now()
+	}
+	if t.healthy == healthy {
+		return
+	}
+	t.healthy = healthy
+	if healthy {
+		targetHealthyGauge.WithLabelValues(t.URL.Host).Set(1)
+		Logger.Info("Target is healthy again.", zap.String("target", t.URL.Host), zap.String("region", t.Region))
+	} else {
+		targetHealthyGauge.WithLabelValues(t.URL.Host).Set(0)
+		Logger.Warn("Target is unhealthy.", zap.String("target", t.URL.Host), zap.String("region", t.Region))
+	}
+}
+
+// TargetGroup holds equivalent targets, e.g. replicated S3 buckets or OpenSearch domains in two regions, in order of preference.
+// Traffic goes to the first healthy target. Targets are marked unhealthy after consecutive failed requests (passive health tracking)
+// and healthy again once a probe succeeds (active health tracking) or, without probes, after a cooldown.
+type TargetGroup struct {
+	targets          []*Target
+	failureThreshold int
+	cooldown         time.Duration
+	probeTransport   http.RoundTripper
+}
+
+func NewTargetGroup(targets ...*Target) *TargetGroup {
+	return &TargetGroup{
+		targets:          targets,
+		failureThreshold: 3,
+		cooldown:         30 * time.Second,
+	}
+}
+
+// WithFailureThreshold sets the number of consecutive failed requests after which a target is marked unhealthy
+func (g *TargetGroup) WithFailureThreshold(failureThreshold int) *TargetGroup {
+	g.failureThreshold = failureThreshold
+	return g
+}
+
+// WithCooldown sets after how long an unhealthy target gets traffic again even if no probe succeeded, 0 waits for a probe
+func (g *TargetGroup) WithCooldown(cooldown time.Duration) *TargetGroup {
+	g.cooldown = cooldown
+	return g
+}
+
+func (g *TargetGroup) Targets() []*Target {
+	return g.targets
+}
+
+// Select returns the first healthy target whose circuit breaker is not open. If there is none, the first one is used.
+func (g *TargetGroup) Select() *Target {
+	for _, target := range g.targets {
+		if (target.Healthy() || g.cooledDown(target)) && !target.breakerOpen() {
+			return target
+		}
+	}
+	return g.targets[0]
+}
+
+func (t *Target) breakerOpen() bool {
+	return t.breaker != nil && t.breaker.State() == gobreaker.StateOpen
+}
+
+// guarded tells whether any target has its own circuit breaker
+func (g *TargetGroup) guarded() bool {
+	for _, target := range g.targets {
+		if target.breaker != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *TargetGroup) cooledDown(target *Target) bool {
+	target.mutex.RLock()
+	defer target.mutex.RUnlock()
+	return g.cooldown > 0 && time.Since(target.unhealthySince) > g.cooldown
+}
+
+// report tracks the health of the target passively from the outcome of a proxied request
+func (g *TargetGroup) report(target *Target, resp *http.Response, err error) {
+	switch upstreamFailure(resp, err) {
+	case "":
+		target.setHealthy(true)
+	case "throttled":
+		// a throttling target is overloaded but not unavailable
+	default:
+		target.mutex.Lock()
+		target.consecutiveFailures++
+		failures := target.consecutiveFailures
+		target.mutex.Unlock()
+
+		if failures >= g.failureThreshold {
+			target.setHealthy(false)
+		}
+	}
+}
+
+// Probe sends a signed GET request to the path of every target and updates its health.
+// The group has to be passed to NewSigningProxy first, whose signing transport is used for the probes.
+func (g *TargetGroup) Probe(path string, timeout time.Duration) {
+	if g.probeTransport == nil {
+		Logger.Warn("Probing targets requires the target group to be used by a signing proxy.")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, target := range g.targets {
+		wg.Add(1)
+		go func(target *Target) {
+			defer wg.Done()
+			err := g.probe(target, path, timeout)
+			if err != nil {
+				Logger.Debug("Probing target failed.", zap.String("target", target.URL.Host), zap.Error(err))
+			}
+			target.setHealthy(err == nil)
+		}(target)
+	}
+	wg.Wait()
+}
+
+func (g *TargetGroup) probe(target *Target, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), targetContextKey{}, target), timeout)
+	defer cancel()
+
+	probeUrl := target.URL.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := g.probeTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("target answered with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// targetFromContext returns the target a request is sent to, if it belongs to a target group
+func targetFromContext(ctx context.Context) (*Target, bool) {
+	target, ok := ctx.Value(targetContextKey{}).(*Target)
+	return target, ok
+}
+
+// failoverTransport sends every request to the currently preferred target of the group.
+// It runs below the retry transport, so a retry of a failed request can already go to the failover target.
+type failoverTransport struct {
+	group *TargetGroup
+	next  http.RoundTripper
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := t.group.Select()
+
+	out := req.Clone(context.WithValue(req.Context(), targetContextKey{}, target))
+	out.URL.Scheme = target.URL.Scheme
+	out.URL.Host = target.URL.Host
+	out.Host = target.URL.Host
+
+	resp, err := t.next.RoundTrip(out)
+	t.group.report(target, resp, err)
+	return resp, err
+}
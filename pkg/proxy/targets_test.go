@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type regionRecordingServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	failing bool
+	regions []string
+}
+
+func newRegionRecordingServer() *regionRecordingServer {
+	s := &regionRecordingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		// Credential=accessKey/20230101/eu-west-1/es/aws4_request
+		credential := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="), "/")
+		if len(credential) > 2 {
+			s.regions = append(s.regions, credential[2])
+		}
+		if s.failing {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	return s
+}
+
+func (s *regionRecordingServer) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+func (s *regionRecordingServer) recordedRegions() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.regions...)
+}
+
+func TestFailoverToSecondaryTarget(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	primary := newRegionRecordingServer()
+	defer primary.Close()
+	secondary := newRegionRecordingServer()
+	defer secondary.Close()
+
+	primaryUrl, _ := url.Parse(primary.URL)
+	secondaryUrl, _ := url.Parse(secondary.URL)
+	targets := NewTargetGroup(NewTarget(primaryUrl, "eu-central-1"), NewTarget(secondaryUrl, "eu-west-1")).
+		WithFailureThreshold(2).
+		WithCooldown(0)
+
+	signingProxy := NewSigningProxy(Config{
+		Target:          primaryUrl,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{ExpiresIn: time.Hour},
+		Targets:         targets,
+	})
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		signingProxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logs/_search", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve())
+
+	primary.setFailing(true)
+	assert.Equal(t, http.StatusBadGateway, serve())
+	assert.Equal(t, http.StatusBadGateway, serve())
+	assert.False(t, targets.Targets()[0].Healthy())
+
+	// the failover target is signed for its own region
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, []string{"eu-west-1"}, secondary.recordedRegions())
+	assert.Equal(t, []string{"eu-central-1", "eu-central-1", "eu-central-1"}, primary.recordedRegions())
+
+	// the primary target gets traffic again once a probe succeeds
+	targets.Probe("/", time.Second)
+	assert.False(t, targets.Targets()[0].Healthy())
+
+	primary.setFailing(false)
+	targets.Probe("/", time.Second)
+	assert.True(t, targets.Targets()[0].Healthy())
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Len(t, primary.recordedRegions(), 6)
+}
+
+func TestEveryTargetHasItsOwnCircuitBreaker(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+
+	primary := newRegionRecordingServer()
+	defer primary.Close()
+	secondary := newRegionRecordingServer()
+	defer secondary.Close()
+
+	settings := circuitbreaker.Settings{Timeout: time.Minute, FailureThreshold: 0}
+	primaryUrl, _ := url.Parse(primary.URL)
+	secondaryUrl, _ := url.Parse(secondary.URL)
+	targets := NewTargetGroup(
+		NewTarget(primaryUrl, "eu-central-1").WithCircuitBreaker(circuitbreaker.NewUpstreamCircuitBreaker("primary-test", settings)),
+		NewTarget(secondaryUrl, "eu-west-1").WithCircuitBreaker(circuitbreaker.NewUpstreamCircuitBreaker("secondary-test", settings)),
+	).WithFailureThreshold(100)
+
+	signingProxy := NewSigningProxy(Config{
+		Target:          primaryUrl,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{},
+		Targets:         targets,
+	})
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		signingProxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logs/_search", nil))
+		return rec.Code
+	}
+
+	primary.setFailing(true)
+	assert.Equal(t, http.StatusBadGateway, serve())
+	assert.Equal(t, gobreaker.StateOpen, targets.Targets()[0].CircuitBreaker().State())
+
+	// the open circuit of the primary target does not stop the traffic to the secondary one
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, gobreaker.StateClosed, targets.Targets()[1].CircuitBreaker().State())
+	assert.Len(t, primary.recordedRegions(), 1)
+	assert.Len(t, secondary.recordedRegions(), 2)
+}
+
+func TestUnhealthyTargetGetsTrafficAfterCooldown(t *testing.T) {
+
+	primaryUrl, _ := url.Parse("https://primary.example.com")
+	secondaryUrl, _ := url.Parse("https://secondary.example.com")
+	targets := NewTargetGroup(NewTarget(primaryUrl, "eu-central-1"), NewTarget(secondaryUrl, "eu-west-1")).
+		WithFailureThreshold(1).
+		WithCooldown(50 * time.Millisecond)
+
+	targets.report(targets.Targets()[0], &http.Response{StatusCode: http.StatusServiceUnavailable}, nil)
+	assert.Equal(t, secondaryUrl, targets.Select().URL)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, primaryUrl, targets.Select().URL)
+
+	// throttling does not make a target unhealthy
+	targets.report(targets.Targets()[0], &http.Response{StatusCode: http.StatusOK}, nil)
+	targets.report(targets.Targets()[0], &http.Response{StatusCode: http.StatusTooManyRequests}, nil)
+	assert.True(t, targets.Targets()[0].Healthy())
+}
@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"net/http"
+)
+
+const tracerName = "github.com/idealo/aws-signing-proxy/pkg/proxy"
+
+// TraceHandler starts a server span for every request, continuing the trace of an incoming traceparent header.
+// Spans are named after the method and the route template, so they can be grouped by route.
+func TraceHandler(next http.Handler, routes *Routes) http.Handler {
+	return otelhttp.NewHandler(next, "proxy",
+		otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+			return req.Method + " " + routes.Template(req.URL.Path)
+		}),
+	)
+}
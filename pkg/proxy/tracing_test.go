@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTracingContinuesIncomingTrace(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+	exporter := withInMemoryTracing(t)
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	routes := NewRoutes([]string{"/{index}/_search"})
+	handler := TraceHandler(NewSigningProxy(Config{
+		Target:          target,
+		Region:          "eu-central-1",
+		Service:         "es",
+		IdleConnTimeout: time.Second,
+		DialTimeout:     time.Second,
+		AuthClient:      &testhelper.ReadClient{ExpiresIn: time.Hour},
+	}), routes)
+
+	req := httptest.NewRequest(http.MethodGet, "/logs/_search", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range exporter.GetSpans().Snapshots() {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), span.Name())
+		spans[span.Name()] = span
+	}
+
+	server := spans["GET /{index}/_search"]
+	if assert.NotNil(t, server) {
+		assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	}
+
+	sign := spans["sign"]
+	retrieve := spans["credentials.retrieve"]
+	if assert.NotNil(t, sign) && assert.NotNil(t, retrieve) {
+		assert.Equal(t, sign.SpanContext().SpanID(), retrieve.Parent().SpanID())
+	}
+
+	client := spans["HTTP GET"]
+	if assert.NotNil(t, client) {
+		assert.Equal(t, trace.SpanKindClient, client.SpanKind())
+		assert.Contains(t, traceparent, client.SpanContext().SpanID().String(), "the upstream continues the trace of the client span")
+	}
+}
+
+func TestTracingRecordsCredentialErrors(t *testing.T) {
+	testhelper.WithoutEnvironmentCredentials(t)
+	exporter := withInMemoryTracing(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rec := proxyRequest(upstream, &testhelper.ReadClient{Failing: true})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var names []string
+	for _, span := range exporter.GetSpans().Snapshots() {
+		names = append(names, span.Name())
+		if span.Name() == "sign" || span.Name() == "credentials.retrieve" {
+			assert.Equal(t, "Error", span.Status().Code.String(), span.Name())
+		}
+	}
+	assert.Contains(t, names, "sign")
+	assert.Contains(t, names, "credentials.retrieve")
+	assert.NotContains(t, names, "HTTP GET", "unsigned requests are not forwarded")
+}
+
+// withInMemoryTracing registers a tracer provider recording all spans for the duration of the test
+func withInMemoryTracing(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return exporter
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// TransportConfig holds the settings of the http.Transport connecting to the upstream.
+// MaxIdleConns and TLSHandshakeTimeout fall back to 100 and 10s if unset, zero means no limit for the other settings.
+type TransportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	ResponseHeaderTimeout time.Duration
+	ExpectContinueTimeout time.Duration
+	TLSHandshakeTimeout   time.Duration
+	// RootCAs verify the certificates of the upstream instead of the system roots if set
+	RootCAs *x509.CertPool
+	// ServerName is sent as SNI and verified instead of the host name, e.g. when connecting through a VPC endpoint with a custom DNS name
+	ServerName    string
+	MinTLSVersion uint16
+	// Proxy replaces the proxy from the environment, credentials in its user info are sent as Proxy-Authorization
+	Proxy *url.URL
+}
+
+// NewTransport creates the transport connecting to the upstream.
+// It is http.DefaultTransport but with the ability to override timeouts, TLS settings and the proxy.
+func NewTransport(config Config) *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if config.Transport.Proxy != nil {
+		proxy = http.ProxyURL(config.Transport.Proxy)
+	}
+	maxIdleConns := config.Transport.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	tlsHandshakeTimeout := config.Transport.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   config.Transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ResponseHeaderTimeout: config.Transport.ResponseHeaderTimeout,
+		ExpectContinueTimeout: config.Transport.ExpectContinueTimeout,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		TLSClientConfig: &tls.Config{
+			RootCAs:    config.Transport.RootCAs,
+			ServerName: config.Transport.ServerName,
+			MinVersion: config.Transport.MinTLSVersion,
+		},
+	}
+}
@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewTransportDefaults(t *testing.T) {
+
+	transport := NewTransport(Config{})
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 10*time.Second, transport.TLSHandshakeTimeout)
+
+	transport = NewTransport(Config{Transport: TransportConfig{MaxIdleConns: 5, TLSHandshakeTimeout: time.Second}})
+	assert.Equal(t, 5, transport.MaxIdleConns)
+	assert.Equal(t, time.Second, transport.TLSHandshakeTimeout)
+}
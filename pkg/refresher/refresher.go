@@ -0,0 +1,231 @@
+package refresher
+
+import (
+	"context"
+	"errors"
+	. "github.com/idealo/aws-signing-proxy/pkg/logging"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"go.uber.org/zap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const minRefreshInterval = 10 * time.Second
+
+// Refresher wraps any proxy.ReadClient and refreshes its credentials in the background ahead of their expiry,
+// so fetching credentials is taken off the request path.
+type Refresher struct {
+	client        proxy.ReadClient
+	name          string
+	refreshBefore time.Duration
+	jitter        time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+
+	mutex     sync.RWMutex
+	current   *proxy.RefreshedCredentials
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewRefresher(client proxy.ReadClient) *Refresher {
+	return &Refresher{
+		client:        client,
+		name:          "credentials",
+		refreshBefore: 4 * time.Minute,
+		jitter:        30 * time.Second,
+		minBackoff:    time.Second,
+		maxBackoff:    time.Minute,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// WithName sets the name used in log messages, e.g. the credentials provider
+func (r *Refresher) WithName(name string) *Refresher {
+	r.name = name
+	return r
+}
+
+// WithRefreshBefore sets how long before their expiry credentials are refreshed
+func (r *Refresher) WithRefreshBefore(refreshBefore time.Duration) *Refresher {
+	r.refreshBefore = refreshBefore
+	return r
+}
+
+// WithJitter sets the maximum random amount of time a refresh is brought forward,
+// so that several proxies do not hit the credentials provider at the same time
+func (r *Refresher) WithJitter(jitter time.Duration) *Refresher {
+	r.jitter = jitter
+	return r
+}
+
+// WithBackoff sets the bounds of the exponential backoff between failed refreshes
+func (r *Refresher) WithBackoff(minBackoff time.Duration, maxBackoff time.Duration) *Refresher {
+	r.minBackoff = minBackoff
+	r.maxBackoff = maxBackoff
+	return r
+}
+
+// Start fetches the credentials and keeps refreshing them in the background until Stop is called
+func (r *Refresher) Start() {
+	r.startOnce.Do(func() {
+		go r.run()
+	})
+}
+
+// Stop ends the background refresh and waits for a running refresh to finish.
+// A refresher which was never started cannot be started afterwards.
+func (r *Refresher) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	r.startOnce.Do(func() {
+		close(r.done)
+	})
+	<-r.done
+}
+
+// RefreshCredentials serves the last fetched credentials as long as they are valid
+// and only falls back to fetching them synchronously once they have expired.
+func (r *Refresher) RefreshCredentials(result interface{}) error {
+	return r.RefreshCredentialsWithContext(context.Background(), result)
+}
+
+// RefreshCredentialsWithContext works like RefreshCredentials and traces a synchronous fetch as part of the request in the context
+func (r *Refresher) RefreshCredentialsWithContext(ctx context.Context, result interface{}) error {
+	refreshedCredentials, ok := result.(*proxy.RefreshedCredentials)
+	if !ok {
+		return errors.New("refresher only supports *proxy.RefreshedCredentials")
+	}
+
+	if current := r.valid(); current != nil {
+		*refreshedCredentials = *current
+		return nil
+	}
+
+	current, err := r.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	*refreshedCredentials = *current
+	return nil
+}
+
+// Name returns the name of the credentials provider of the wrapped client
+func (r *Refresher) Name() string {
+	if namedClient, ok := r.client.(proxy.NamedReadClient); ok {
+		return namedClient.Name()
+	}
+	return r.name
+}
+
+// ExpireCredentials drops the credentials of the refresher and of the wrapped client, so the next refresh fetches new ones
+func (r *Refresher) ExpireCredentials() {
+	if cachingClient, ok := r.client.(proxy.CachingReadClient); ok {
+		cachingClient.ExpireCredentials()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = nil
+}
+
+func (r *Refresher) run() {
+	defer close(r.done)
+
+	failures := 0
+	wait := time.Duration(0)
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		current, err := r.refresh(context.Background())
+		if err != nil {
+			failures++
+			wait = r.backoff(failures)
+			Logger.Error("Refreshing credentials in the background failed",
+				zap.String("name", r.name),
+				zap.Int("failures", failures),
+				zap.Duration("retry-in", wait),
+				zap.Error(err))
+			continue
+		}
+
+		failures = 0
+		wait = r.nextRefresh(current.ExpiresAt)
+		Logger.Debug("Refreshed credentials in the background",
+			zap.String("name", r.name),
+			zap.Time("expires-at", current.ExpiresAt),
+			zap.Duration("next-refresh-in", wait))
+	}
+}
+
+func (r *Refresher) refresh(ctx context.Context) (*proxy.RefreshedCredentials, error) {
+	refreshed := &proxy.RefreshedCredentials{}
+	var err error
+	if contextClient, ok := r.client.(proxy.ContextReadClient); ok {
+		err = contextClient.RefreshCredentialsWithContext(ctx, refreshed)
+	} else {
+		err = r.client.RefreshCredentials(refreshed)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = refreshed
+	return refreshed, nil
+}
+
+func (r *Refresher) valid() *proxy.RefreshedCredentials {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.current == nil || !time.Now().Before(r.current.ExpiresAt) {
+		return nil
+	}
+	return r.current
+}
+
+// nextRefresh schedules the refresh refreshBefore ahead of the expiry, brought forward by a random jitter
+func (r *Refresher) nextRefresh(expiresAt time.Time) time.Duration {
+	wait := time.Until(expiresAt.Add(-r.refreshBefore))
+	if r.jitter > 0 {
+		wait -= time.Duration(rand.Int63n(int64(r.jitter)))
+	}
+
+	// credentials living shorter than the refresh window are refreshed after half of their remaining lifetime
+	if wait < minRefreshInterval {
+		wait = time.Until(expiresAt) / 2
+	}
+	if wait < r.minBackoff {
+		wait = r.minBackoff
+	}
+	return wait
+}
+
+// backoff doubles the wait time with every consecutive failure and adds up to 50% jitter
+func (r *Refresher) backoff(failures int) time.Duration {
+	wait := r.minBackoff
+	for i := 1; i < failures && wait < r.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.maxBackoff {
+		wait = r.maxBackoff
+	}
+	if wait/2 > 0 {
+		wait += time.Duration(rand.Int63n(int64(wait / 2)))
+	}
+	return wait
+}
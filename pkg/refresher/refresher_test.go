@@ -0,0 +1,111 @@
+package refresher
+
+import (
+	"github.com/idealo/aws-signing-proxy/pkg/internal/testhelper"
+	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRefresherServesCachedCredentials(t *testing.T) {
+
+	client := &testhelper.ReadClient{ExpiresIn: time.Hour}
+	refresher := NewRefresher(client)
+	refresher.Start()
+	defer refresher.Stop()
+
+	assert.Eventually(t, func() bool { return client.Calls() == 1 }, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		rc := &proxy.RefreshedCredentials{}
+		assert.NoError(t, refresher.RefreshCredentials(rc))
+		assert.Equal(t, "accessKey", rc.Data.AccessKey)
+	}
+
+	assert.Equal(t, 1, client.Calls())
+}
+
+func TestRefresherRefreshesAheadOfExpiry(t *testing.T) {
+
+	client := &testhelper.ReadClient{ExpiresIn: 300 * time.Millisecond}
+	refresher := NewRefresher(client).
+		WithRefreshBefore(200*time.Millisecond).
+		WithJitter(0).
+		WithBackoff(50*time.Millisecond, 100*time.Millisecond)
+	refresher.Start()
+	defer refresher.Stop()
+
+	assert.Eventually(t, func() bool { return client.Calls() >= 3 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRefresherKeepsServingLastValidCredentialsOnFailure(t *testing.T) {
+
+	client := &testhelper.ReadClient{ExpiresIn: 500 * time.Millisecond}
+	refresher := NewRefresher(client).
+		WithRefreshBefore(450*time.Millisecond).
+		WithJitter(0).
+		WithBackoff(20*time.Millisecond, 40*time.Millisecond)
+
+	rc := &proxy.RefreshedCredentials{}
+	assert.NoError(t, refresher.RefreshCredentials(rc))
+
+	client.SetFailing(true)
+	refresher.Start()
+	defer refresher.Stop()
+
+	// the background refresh keeps failing, but the credentials are still valid
+	assert.Eventually(t, func() bool { return client.Calls() >= 4 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, refresher.RefreshCredentials(rc))
+	assert.Equal(t, "accessKey", rc.Data.AccessKey)
+
+	// once they have expired, the error is surfaced
+	time.Sleep(time.Until(rc.ExpiresAt))
+	assert.Error(t, refresher.RefreshCredentials(&proxy.RefreshedCredentials{}))
+}
+
+func TestRefresherFetchesSynchronouslyWhenNotStarted(t *testing.T) {
+
+	client := &testhelper.ReadClient{ExpiresIn: time.Hour}
+	refresher := NewRefresher(client)
+
+	rc := &proxy.RefreshedCredentials{}
+	assert.NoError(t, refresher.RefreshCredentials(rc))
+	assert.NoError(t, refresher.RefreshCredentials(rc))
+
+	assert.Equal(t, 1, client.Calls())
+	assert.Equal(t, "securityToken", rc.Data.SecurityToken)
+}
+
+func TestStopWithoutStart(t *testing.T) {
+
+	client := &testhelper.ReadClient{}
+	refresher := NewRefresher(client)
+
+	stopped := make(chan struct{})
+	go func() {
+		refresher.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on a refresher which was never started")
+	}
+
+	// starting it afterwards does not fetch credentials in the background
+	refresher.Start()
+	refresher.Stop()
+	assert.Equal(t, 0, client.Calls())
+}
+
+func TestBackoff(t *testing.T) {
+
+	refresher := NewRefresher(&testhelper.ReadClient{}).WithBackoff(time.Second, 10*time.Second)
+
+	assert.GreaterOrEqual(t, refresher.backoff(1), time.Second)
+	assert.Less(t, refresher.backoff(1), 1500*time.Millisecond)
+	assert.GreaterOrEqual(t, refresher.backoff(3), 4*time.Second)
+	assert.GreaterOrEqual(t, refresher.backoff(10), 10*time.Second)
+	assert.Less(t, refresher.backoff(10), 15*time.Second)
+}
@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
+	"io"
 	"net/http"
 )
 
@@ -51,21 +54,68 @@ func (g *GetRequest) WithPath(path string) *GetRequest {
 }
 
 func (g *GetRequest) Do(response interface{}) error {
-	vaultTargetUrl := fmt.Sprintf("%s/v1/%s", g.httpClient.baseUrl, g.path)
-	req, err := http.NewRequest(http.MethodGet, vaultTargetUrl, nil)
+	r, err := g.httpClient.send(http.MethodGet, g.path, g.header, nil)
 	if err != nil {
 		return err
 	}
-	for name, value := range g.header {
-		req.Header.Add(name, value[0])
+	defer r.Body.Close()
+
+	return json.NewDecoder(r.Body).Decode(response)
+}
+
+type PutRequest struct {
+	httpClient *RestClient
+	header     http.Header
+	path       string
+}
+
+func (h *RestClient) Put() *PutRequest {
+	return &PutRequest{
+		httpClient: h,
+		header:     map[string][]string{},
 	}
-	r, err := g.httpClient.client.Do(req)
+}
+
+func (p *PutRequest) WithHeader(name string, value string) *PutRequest {
+	p.header.Add(name, value)
+	return p
+}
+
+func (p *PutRequest) WithPath(path string) *PutRequest {
+	p.path = path
+	return p
+}
+
+// Do sends the body as JSON and ignores the response apart from its status code
+func (p *PutRequest) Do(body interface{}) error {
+	content, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
-	if r.StatusCode > 299 {
-		return fmt.Errorf("encountered error while connecting to vault '%s'. status-code: %d", vaultTargetUrl, r.StatusCode)
+	r, err := p.httpClient.send(http.MethodPut, p.path, p.header, bytes.NewReader(content))
+	if err != nil {
+		return err
 	}
+	_, _ = io.Copy(io.Discard, r.Body)
+	return r.Body.Close()
+}
 
-	return json.NewDecoder(r.Body).Decode(response)
+func (h *RestClient) send(method string, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	vaultTargetUrl := fmt.Sprintf("%s/v1/%s", h.baseUrl, path)
+	req, err := http.NewRequest(method, vaultTargetUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range header {
+		req.Header.Add(name, value[0])
+	}
+	r, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode > 299 {
+		_ = r.Body.Close()
+		return nil, circuitbreaker.NewStatusError(r.StatusCode, fmt.Sprintf("encountered error while connecting to vault '%s'. status-code: %d", vaultTargetUrl, r.StatusCode))
+	}
+	return r, nil
 }
@@ -1,23 +1,32 @@
 package vault
 
 import (
+	"context"
+	"fmt"
 	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
 	"github.com/idealo/aws-signing-proxy/pkg/proxy"
+	"github.com/idealo/aws-signing-proxy/pkg/tracing"
 	"github.com/idealo/aws-signing-proxy/pkg/vault/internal"
+	"go.opentelemetry.io/otel"
 	"net/http"
+	"sync"
 	"time"
 )
 
+const tracerName = "github.com/idealo/aws-signing-proxy/pkg/vault"
+
 type Client struct {
-	restClient *internal.RestClient
-	httpClient *http.Client
-	baseUrl    string
-	token      string
+	restClient      *internal.RestClient
+	httpClient      *http.Client
+	baseUrl         string
+	token           string
+	breakerSettings circuitbreaker.Settings
 }
 
 func NewVaultClient() *Client {
 	return &Client{
-		restClient: internal.NewRestClient(),
+		restClient:      internal.NewRestClient(),
+		breakerSettings: circuitbreaker.DefaultSettings(),
 	}
 }
 
@@ -36,9 +45,20 @@ func (c *Client) WithToken(token string) *Client {
 	return c
 }
 
+// WithCircuitBreakerSettings sets the settings of the circuit breaker guarding Vault
+func (c *Client) WithCircuitBreakerSettings(settings circuitbreaker.Settings) *Client {
+	c.breakerSettings = settings
+	return c
+}
+
 type ReadClient struct {
-	path      string
-	getClient *internal.GetRequest
+	path         string
+	getClient    *internal.GetRequest
+	revokeClient *internal.PutRequest
+	breaker      *circuitbreaker.CircuitBreaker
+	mutex        sync.Mutex
+	// leases maps the ids of the leases read and not yet expired to their expiry
+	leases map[string]time.Time
 }
 
 func (c *Client) ReadFrom(path string) *ReadClient {
@@ -52,23 +72,88 @@ func (c *Client) ReadFrom(path string) *ReadClient {
 		WithHeader("X-Vault-Token", c.token).
 		WithPath(path)
 
+	revokeClient := c.restClient.
+		Put().
+		WithHeader("X-Vault-Token", c.token).
+		WithPath("sys/leases/revoke")
+
 	r := &ReadClient{
-		getClient: getClient,
-		path:      path,
+		getClient:    getClient,
+		revokeClient: revokeClient,
+		path:         path,
+		breaker:      circuitbreaker.NewCircuitBreakerWithSettings("vault", c.breakerSettings),
+		leases:       map[string]time.Time{},
 	}
 
 	return r
 }
 
-var breaker = circuitbreaker.NewCircuitBreaker()
-
 func (r *ReadClient) RefreshCredentials(result interface{}) error {
+	return r.RefreshCredentialsWithContext(context.Background(), result)
+}
+
+// RefreshCredentialsWithContext traces reading the credentials from Vault as part of the request in the context
+func (r *ReadClient) RefreshCredentialsWithContext(ctx context.Context, result interface{}) error {
 	refreshedCreds := result.(*proxy.RefreshedCredentials)
 
-	_, err := breaker.Execute(func() (interface{}, error) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "vault.read")
+	start := time.Now()
+	_, err := r.breaker.Execute(func() (interface{}, error) {
 		return nil, r.getClient.Do(result)
 	})
+	proxy.ObserveRefresh(r.Name(), start, err)
+	tracing.End(span, err)
 
 	refreshedCreds.ExpiresAt = time.Now().Add(time.Duration(refreshedCreds.LeaseDuration) * time.Second)
+	if err == nil && refreshedCreds.LeaseId != "" {
+		r.addLease(refreshedCreds.LeaseId, refreshedCreds.ExpiresAt)
+	}
 	return err
 }
+
+func (r *ReadClient) addLease(id string, expiresAt time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for lease, leaseExpiresAt := range r.leases {
+		if !now.Before(leaseExpiresAt) {
+			delete(r.leases, lease)
+		}
+	}
+	r.leases[id] = expiresAt
+}
+
+// RevokeLeases revokes the leases of all credentials read and not yet expired, so they cannot be used after the proxy is gone.
+// Leases which cannot be revoked are kept to be tried again.
+func (r *ReadClient) RevokeLeases(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, span := otel.Tracer(tracerName).Start(ctx, "vault.revoke")
+	var lastErr error
+	failed := 0
+	for lease := range r.leases {
+		if err := r.revokeClient.Do(map[string]string{"lease_id": lease}); err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		delete(r.leases, lease)
+	}
+
+	var err error
+	if lastErr != nil {
+		err = fmt.Errorf("failed revoking %d vault leases: %w", failed, lastErr)
+	}
+	tracing.End(span, err)
+	return err
+}
+
+func (r *ReadClient) CircuitBreaker() *circuitbreaker.CircuitBreaker {
+	return r.breaker
+}
+
+func (r *ReadClient) Name() string {
+	return "vault"
+}
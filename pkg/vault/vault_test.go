@@ -1,12 +1,16 @@
 package vault
 
 import (
+	"context"
 	"encoding/json"
+	"github.com/idealo/aws-signing-proxy/pkg/circuitbreaker"
 	"github.com/idealo/aws-signing-proxy/pkg/proxy"
 	"github.com/idealo/aws-signing-proxy/pkg/vault/internal"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -52,6 +56,7 @@ func TestRefreshCredentials(t *testing.T) {
 	client := ReadClient{
 		path:      "foo",
 		getClient: getClient,
+		breaker:   circuitbreaker.NewCircuitBreaker("vault"),
 	}
 
 	rc := &proxy.RefreshedCredentials{}
@@ -66,3 +71,90 @@ func TestRefreshCredentials(t *testing.T) {
 	assert.Equal(t, "foobarSecurityToken", rc.Data.SecurityToken)
 
 }
+
+func TestCircuitBreakerIsScopedToReadClient(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/healthy":
+			_, _ = w.Write([]byte(`{"lease_duration":3600,"data":{"access_key":"fooAccessKey"}}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer mockServer.Close()
+
+	broken := NewVaultClient().WithBaseUrl(mockServer.URL).ReadFrom("broken")
+	healthy := NewVaultClient().WithBaseUrl(mockServer.URL).ReadFrom("healthy")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = broken.RefreshCredentials(&proxy.RefreshedCredentials{})
+		}()
+		go func() {
+			defer wg.Done()
+			rc := &proxy.RefreshedCredentials{}
+			assert.NoError(t, healthy.RefreshCredentials(rc))
+			assert.Equal(t, "fooAccessKey", rc.Data.AccessKey)
+		}()
+	}
+	wg.Wait()
+
+	err := broken.RefreshCredentials(&proxy.RefreshedCredentials{})
+	assert.ErrorContains(t, err, "circuit breaker is open")
+	assert.NoError(t, healthy.RefreshCredentials(&proxy.RefreshedCredentials{}))
+}
+
+func TestClientErrorsDoNotTripCircuitBreaker(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer mockServer.Close()
+
+	client := NewVaultClient().
+		WithBaseUrl(mockServer.URL).
+		WithCircuitBreakerSettings(circuitbreaker.Settings{Timeout: time.Minute, FailureThreshold: 1}).
+		ReadFrom("denied")
+
+	for i := 0; i < 5; i++ {
+		err := client.RefreshCredentials(&proxy.RefreshedCredentials{})
+		assert.ErrorContains(t, err, "status-code: 403")
+	}
+	assert.Equal(t, "closed", client.CircuitBreaker().State().String())
+}
+
+func TestRevokeLeases(t *testing.T) {
+
+	var revoked []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/aws/creds/search":
+			_, _ = w.Write([]byte(`{"lease_id":"aws/creds/search/` + strconv.Itoa(len(revoked)) + `","lease_duration":3600,"data":{"access_key":"fooAccessKey"}}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/revoke":
+			assert.Equal(t, "token", r.Header.Get("X-Vault-Token"))
+			var body map[string]string
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			revoked = append(revoked, body["lease_id"])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	client := NewVaultClient().WithBaseUrl(mockServer.URL).WithToken("token").ReadFrom("aws/creds/search")
+	rc := &proxy.RefreshedCredentials{}
+	assert.NoError(t, client.RefreshCredentials(rc))
+	assert.Equal(t, "aws/creds/search/0", rc.LeaseId)
+
+	assert.NoError(t, client.RevokeLeases(context.Background()))
+	assert.Equal(t, []string{"aws/creds/search/0"}, revoked)
+
+	// revoked leases are not revoked again
+	assert.NoError(t, client.RevokeLeases(context.Background()))
+	assert.Len(t, revoked, 1)
+}